@@ -0,0 +1,37 @@
+package downloadutils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes data to a temporary .part file next to path and renames it into place,
+// so readers never see a half-written file under the final name
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.part")
+	if err != nil {
+		return &IOError{fmt.Errorf("failed to create temporary file: %v", err)}
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return &IOError{fmt.Errorf("failed to write temporary file: %v", err)}
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return &IOError{fmt.Errorf("failed to write temporary file: %v", err)}
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return &IOError{fmt.Errorf("failed to set permissions: %v", err)}
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return &IOError{fmt.Errorf("failed to rename temporary file: %v", err)}
+	}
+	return nil
+}
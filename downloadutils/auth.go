@@ -0,0 +1,333 @@
+package downloadutils
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"wget/models"
+)
+
+// credentials are what we can authenticate to a host with
+type credentials struct {
+	user     string
+	password string
+	bearer   string
+}
+
+// challenge is a parsed WWW-Authenticate challenge
+type challenge struct {
+	scheme string            // "basic" or "digest"
+	params map[string]string // Lower-cased parameter names
+}
+
+// digestState remembers a host's Digest challenge so later requests can answer it up front
+type digestState struct {
+	challenge challenge
+	nc        int // Nonce count, incremented for every request using the nonce
+}
+
+// authTransport answers Basic and Digest challenges and adds bearer tokens.
+// Credentials given on the command line only go to the hosts the user asked for,
+// never to hosts we got redirected to; .netrc credentials go to the host they name.
+type authTransport struct {
+	base  http.RoundTripper
+	opts  *models.Options
+	netrc []netrcEntry
+
+	mu      sync.Mutex
+	hosts   map[string]bool         // Hosts allowed to receive the command line credentials
+	schemes map[string]string       // Scheme each host asked for last time ("basic" or "digest")
+	digests map[string]*digestState // Digest challenge per host
+}
+
+// newAuthTransport wraps base with authentication support
+func newAuthTransport(base http.RoundTripper, opts *models.Options) *authTransport {
+	a := &authTransport{
+		base:    base,
+		opts:    opts,
+		hosts:   make(map[string]bool),
+		schemes: make(map[string]string),
+		digests: make(map[string]*digestState),
+	}
+	if !opts.NoNetrc {
+		a.netrc = loadNetrc()
+	}
+	return a
+}
+
+// authorizeHost lets the command line credentials be sent to the host of rawURL
+func (a *authTransport) authorizeHost(rawURL string) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.hosts[strings.ToLower(u.Host)] = true
+}
+
+// credentialsFor returns the credentials to use for a URL, or nil
+func (a *authTransport) credentialsFor(u *url.URL) *credentials {
+	a.mu.Lock()
+	trusted := a.hosts[strings.ToLower(u.Host)]
+	a.mu.Unlock()
+
+	if trusted {
+		if a.opts.BearerToken != "" {
+			return &credentials{bearer: a.opts.BearerToken}
+		}
+		if a.opts.User != "" {
+			return &credentials{user: a.opts.User, password: a.opts.Password}
+		}
+	}
+
+	// Credentials embedded in the URL itself
+	if u.User != nil {
+		password, _ := u.User.Password()
+		return &credentials{user: u.User.Username(), password: password}
+	}
+
+	if entry, ok := lookupNetrc(a.netrc, u.Hostname()); ok && entry.login != "" {
+		return &credentials{user: entry.login, password: entry.password}
+	}
+	return nil
+}
+
+// RoundTrip implements http.RoundTripper
+func (a *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	creds := a.credentialsFor(req.URL)
+	if creds == nil || req.Header.Get("Authorization") != "" {
+		return a.base.RoundTrip(req)
+	}
+
+	host := strings.ToLower(req.URL.Host)
+	if creds.bearer != "" {
+		return a.base.RoundTrip(a.withAuthorization(req, "Bearer "+creds.bearer))
+	}
+
+	// Answer up front if the host challenged us before
+	sentScheme := ""
+	if authorization := a.knownAuthorization(req, host, creds); authorization != "" {
+		sentScheme = a.scheme(host)
+		req = a.withAuthorization(req, authorization)
+	}
+
+	resp, err := a.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// Retry once with an answer to the challenge
+	chosen, ok := pickChallenge(resp.Header.Values("WWW-Authenticate"))
+	if !ok {
+		return resp, nil
+	}
+	if chosen.scheme == sentScheme && !strings.EqualFold(chosen.params["stale"], "true") {
+		// Our answer was already rejected, the credentials are wrong
+		return resp, nil
+	}
+	if req.Body != nil && req.GetBody == nil {
+		// The body is gone, we can't send the request again
+		return resp, nil
+	}
+
+	a.remember(host, chosen)
+	authorization := a.knownAuthorization(req, host, creds)
+	if authorization == "" {
+		return resp, nil
+	}
+
+	retry := a.withAuthorization(req, authorization)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry.Body = body
+	}
+	resp.Body.Close()
+	return a.base.RoundTrip(retry)
+}
+
+// withAuthorization returns a copy of req carrying an Authorization header
+func (a *authTransport) withAuthorization(req *http.Request, authorization string) *http.Request {
+	clone := req.Clone(req.Context())
+	clone.Header.Set("Authorization", authorization)
+	return clone
+}
+
+// scheme returns the authentication scheme the host asked for, if any
+func (a *authTransport) scheme(host string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.schemes[host]
+}
+
+// remember records the challenge a host sent
+func (a *authTransport) remember(host string, c challenge) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.schemes[host] = c.scheme
+	if c.scheme == "digest" {
+		a.digests[host] = &digestState{challenge: c}
+	}
+}
+
+// knownAuthorization builds the Authorization header for a host that challenged us before
+func (a *authTransport) knownAuthorization(req *http.Request, host string, creds *credentials) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch a.schemes[host] {
+	case "basic":
+		// Built by hand, RoundTrip must not modify the caller's request
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(creds.user+":"+creds.password))
+	case "digest":
+		state := a.digests[host]
+		state.nc++
+		authorization, err := digestAuthorization(state.challenge, req.Method, req.URL.RequestURI(), creds, state.nc)
+		if err != nil {
+			return ""
+		}
+		return authorization
+	}
+	return ""
+}
+
+// parseChallenge parses one WWW-Authenticate header value (e.g., `Digest realm="x", nonce="y"`)
+func parseChallenge(header string) (challenge, bool) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	c := challenge{scheme: strings.ToLower(scheme), params: make(map[string]string)}
+	if c.scheme == "" {
+		return c, false
+	}
+
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, `"`) {
+			// Quoted string, possibly containing commas and escaped quotes
+			var b strings.Builder
+			i := 1
+			for ; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				b.WriteByte(value[i])
+			}
+			c.params[key] = b.String()
+			rest = strings.TrimPrefix(strings.TrimSpace(value[min(i+1, len(value)):]), ",")
+		} else {
+			token, remaining, _ := strings.Cut(value, ",")
+			c.params[key] = strings.TrimSpace(token)
+			rest = remaining
+		}
+	}
+	return c, true
+}
+
+// pickChallenge chooses the strongest challenge we support, preferring Digest over Basic
+func pickChallenge(headers []string) (challenge, bool) {
+	var basic *challenge
+	for _, header := range headers {
+		c, ok := parseChallenge(header)
+		if !ok {
+			continue
+		}
+		switch c.scheme {
+		case "digest":
+			if _, err := digestHash(c.params["algorithm"]); err == nil {
+				return c, true
+			}
+		case "basic":
+			basic = &c
+		}
+	}
+	if basic != nil {
+		return *basic, true
+	}
+	return challenge{}, false
+}
+
+// digestHash returns the hash for a Digest algorithm (MD5, SHA-256, SHA-512-256 and their -sess variants)
+func digestHash(algorithm string) (func() hash.Hash, error) {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		return md5.New, nil
+	case "SHA-256":
+		return sha256.New, nil
+	case "SHA-512-256":
+		return sha512.New512_256, nil
+	}
+	return nil, &AuthError{fmt.Errorf("unsupported digest algorithm: %s", algorithm)}
+}
+
+// digestAuthorization answers a Digest challenge (RFC 7616)
+func digestAuthorization(c challenge, method, uri string, creds *credentials, nc int) (string, error) {
+	newHash, err := digestHash(c.params["algorithm"])
+	if err != nil {
+		return "", err
+	}
+	h := func(s string) string {
+		sum := newHash()
+		sum.Write([]byte(s))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	realm, nonce := c.params["realm"], c.params["nonce"]
+
+	cnonceBytes := make([]byte, 16)
+	if _, err := rand.Read(cnonceBytes); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(cnonceBytes)
+	ncValue := fmt.Sprintf("%08x", nc)
+
+	ha1 := h(creds.user + ":" + realm + ":" + creds.password)
+	if strings.HasSuffix(strings.ToUpper(c.params["algorithm"]), "-SESS") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	// We only do qop=auth (not auth-int), or the legacy RFC 2069 form without qop
+	qop := ""
+	for _, option := range strings.Split(c.params["qop"], ",") {
+		if strings.TrimSpace(option) == "auth" {
+			qop = "auth"
+		}
+	}
+
+	var response string
+	if qop != "" {
+		response = h(ha1 + ":" + nonce + ":" + ncValue + ":" + cnonce + ":" + qop + ":" + ha2)
+	} else {
+		response = h(ha1 + ":" + nonce + ":" + ha2)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username=%q, realm=%q, nonce=%q, uri=%q, response=%q`, creds.user, realm, nonce, uri, response)
+	if algorithm := c.params["algorithm"]; algorithm != "" {
+		fmt.Fprintf(&b, ", algorithm=%s", algorithm)
+	}
+	if qop != "" {
+		fmt.Fprintf(&b, `, qop=%s, nc=%s, cnonce=%q`, qop, ncValue, cnonce)
+	}
+	if opaque, ok := c.params["opaque"]; ok {
+		fmt.Fprintf(&b, ", opaque=%q", opaque)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,248 @@
+package downloadutils
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// newHash returns a hash for a checksum algorithm name (md5, sha1, sha256, sha512)
+func newHash(algo string) (hash.Hash, error) {
+	switch strings.ToLower(algo) {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, &ParseError{fmt.Errorf("unsupported checksum algorithm: %q", algo)}
+}
+
+// parseChecksum splits a checksum spec (e.g., "sha256:ab12...") into algorithm and hex digest
+func parseChecksum(spec string) (algo, digest string, err error) {
+	algo, digest, ok := strings.Cut(strings.TrimSpace(spec), ":")
+	if !ok || digest == "" {
+		return "", "", &ParseError{fmt.Errorf("invalid checksum %q, expected ALGO:HEX", spec)}
+	}
+
+	h, err := newHash(algo)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != h.Size()*2 {
+		return "", "", &ParseError{fmt.Errorf("invalid %s digest: %q", algo, digest)}
+	}
+
+	return strings.ToLower(algo), strings.ToLower(digest), nil
+}
+
+// fileDigest computes the hex digest of a file
+func fileDigest(path, algo string) (string, error) {
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", &IOError{fmt.Errorf("failed to open file for checksum: %v", err)}
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(h, file); err != nil {
+		return "", &IOError{fmt.Errorf("failed to read file for checksum: %v", err)}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ChecksumError reports a download whose digest doesn't match the expected checksum
+type ChecksumError struct {
+	Algorithm string
+	File      string // Base name of the file, empty for streamed downloads
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("%s checksum mismatch: expected %s, got %s", e.Algorithm, e.Expected, e.Actual)
+	}
+	return fmt.Sprintf("%s checksum mismatch for %s: expected %s, got %s", e.Algorithm, e.File, e.Expected, e.Actual)
+}
+
+// verifyChecksum checks a downloaded file against a checksum spec
+func verifyChecksum(path, spec string) error {
+	algo, expected, err := parseChecksum(spec)
+	if err != nil {
+		return err
+	}
+
+	actual, err := fileDigest(path, algo)
+	if err != nil {
+		return err
+	}
+
+	if actual != expected {
+		return &ChecksumError{Algorithm: algo, File: filepath.Base(path), Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+// verifyStreamChecksum compares the digest of bytes that were streamed (e.g., to stdout) with spec
+func verifyStreamChecksum(h hash.Hash, spec string) error {
+	algo, expected, err := parseChecksum(spec)
+	if err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		return &ChecksumError{Algorithm: algo, Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+// manifestAlgorithm guesses the hash algorithm of a manifest from its name (e.g., SHA256SUMS)
+func manifestAlgorithm(path string) string {
+	name := strings.ToLower(filepath.Base(path))
+	switch {
+	case strings.Contains(name, "sha512"):
+		return "sha512"
+	case strings.Contains(name, "sha1"):
+		return "sha1"
+	case strings.Contains(name, "md5"):
+		return "md5"
+	}
+	return "sha256"
+}
+
+// manifestName returns the name a file is listed under in a manifest (relative to the manifest)
+func manifestName(manifestPath, filePath string) string {
+	rel, err := filepath.Rel(filepath.Dir(manifestPath), filePath)
+	if err != nil {
+		rel = filepath.Base(filePath)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// readManifest reads a sha256sum-style manifest ("<hex>  <name>" per line)
+func readManifest(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, &IOError{fmt.Errorf("failed to open manifest: %w", err)}
+	}
+	defer file.Close()
+
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		digest, name, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, &ParseError{fmt.Errorf("invalid manifest line: %q", line)}
+		}
+		// A leading '*' marks binary mode in sha256sum output
+		name = strings.TrimPrefix(strings.TrimSpace(name), "*")
+		entries[name] = strings.ToLower(digest)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, &IOError{fmt.Errorf("failed to read manifest: %v", err)}
+	}
+	return entries, nil
+}
+
+// writeManifest writes a sha256sum-style manifest sorted by name
+func writeManifest(path string, entries map[string]string) error {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s  %s\n", entries[name], name)
+	}
+
+	// Written aside and renamed, so a crash never leaves a truncated manifest
+	return WriteFileAtomic(path, []byte(b.String()), 0o644)
+}
+
+// applyManifest verifies the successful results against an existing manifest,
+// or writes a new manifest for them if none exists yet and all of them succeeded.
+// Results that fail verification are marked as failed, and deleted if this run downloaded them.
+func applyManifest(manifestPath string, results []Result) error {
+	algo := manifestAlgorithm(manifestPath)
+
+	expected, err := readManifest(manifestPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		// No manifest yet, record what we downloaded, but only once every file is there
+		for _, result := range results {
+			if !result.Success {
+				fmt.Printf("not writing %s: %s did not download\n", manifestPath, result.URL)
+				return nil
+			}
+		}
+		entries := make(map[string]string)
+		for _, result := range results {
+			digest, err := fileDigest(result.OutputPath, algo)
+			if err != nil {
+				return err
+			}
+			entries[manifestName(manifestPath, result.OutputPath)] = digest
+		}
+		if err := writeManifest(manifestPath, entries); err != nil {
+			return err
+		}
+		fmt.Printf("wrote %d checksums to %s\n", len(entries), manifestPath)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Verify every file listed in the manifest
+	verified := 0
+	for i, result := range results {
+		if !result.Success {
+			continue
+		}
+		digest, ok := expected[manifestName(manifestPath, result.OutputPath)]
+		if !ok {
+			fmt.Printf("Warning: %s is not listed in %s\n", result.OutputPath, manifestPath)
+			continue
+		}
+		if err := verifyChecksum(result.OutputPath, algo+":"+digest); err != nil {
+			// A file kept from before (e.g., --no-clobber) is the user's, not ours to delete
+			var checksumErr *ChecksumError
+			if errors.As(err, &checksumErr) && !result.Skipped {
+				os.Remove(result.OutputPath)
+			}
+			fmt.Printf("Error verifying %s: %v\n", result.URL, err)
+			results[i].Success = false
+			results[i].Error = err
+			continue
+		}
+		verified++
+	}
+	fmt.Printf("verified %d checksums against %s\n", verified, manifestPath)
+	return nil
+}
@@ -0,0 +1,376 @@
+package downloadutils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"wget/models"
+)
+
+// EventType tells what an Event reports
+type EventType int
+
+const (
+	EventStart    EventType = iota // A download began
+	EventProgress                  // Bytes arrived: Written of Total (-1 or 0 if unknown)
+	EventRetry                     // An attempt failed with Err, attempt number Attempt starts after Delay
+	EventSkip                      // The file was kept as it is (already there or not modified)
+	EventDone                      // The download finished with Written bytes
+	EventError                     // The download failed with Err
+)
+
+// Reasons an EventSkip gives for keeping a file
+const (
+	SkipExists      = "already exists" // The file is already there (--no-clobber)
+	SkipNotModified = "not modified"   // The server file is no newer than the local one (-N)
+)
+
+// Event reports what a Client is doing, in place of the messages the command line prints
+type Event struct {
+	Type       EventType
+	ID         uint64 // Tells apart the events of different downloads, even of the same URL
+	URL        string
+	OutputPath string
+	Written    int64 // Bytes of the file we have, including those of a resumed download
+	Total      int64 // Size of the whole file, if known
+	Attempt    int
+	Delay      time.Duration
+	Err        error
+	Reason     string // Why the file was skipped: SkipExists or SkipNotModified
+}
+
+// EventHandler receives the events of a Client. With DoAll it is called from several
+// goroutines at once, and it should return quickly since downloads wait for it.
+type EventHandler func(Event)
+
+// Request describes a single download
+type Request struct {
+	URL string
+	// File to save to; empty picks a name from the URL, inside Dir
+	OutputPath string
+	Dir        string
+	// Receives the body instead of a file when set; interrupted transfers resume where they stopped
+	Writer io.Writer
+	// Expected checksum (e.g., "sha256:<hex>"), verified before the file gets its name
+	Checksum string
+}
+
+// Response describes the outcome of a download
+type Response struct {
+	URL        string
+	OutputPath string // Final name of the file, which may differ from the requested one
+	Size       int64
+	Attempts   int
+	Skipped    bool // The existing file was kept
+	Duration   time.Duration
+	Err        error
+}
+
+// Client downloads files for programs embedding this package. It prints nothing unless
+// given WithOutput, reporting progress to its EventHandler instead. Requests share one
+// Session, so cookies and credentials carry over; Close the Client when done with it.
+type Client struct {
+	opts        *models.Options
+	session     *Session
+	ownSession  bool // The session was created by NewClient, which closes it
+	handler     EventHandler
+	output      io.Writer // wget style messages and progress bar, if any
+	concurrency int
+	base        *models.Options         // Given by WithOptions, if any
+	changes     []func(*models.Options) // Applied by NewClient on top of the base options
+	sessionSet  []string                // Options that set up the session rather than the transfers
+}
+
+// ClientOption configures a Client
+type ClientOption func(*Client)
+
+// change makes an option that adjusts the Client's download options
+func change(adjust func(opts *models.Options)) ClientOption {
+	return func(c *Client) {
+		c.changes = append(c.changes, adjust)
+	}
+}
+
+// sessionChange makes an option that adjusts the settings the Client's session is created
+// with, which a session given by WithSession already has. name is the option, for errors.
+func sessionChange(name string, adjust func(opts *models.Options)) ClientOption {
+	return func(c *Client) {
+		c.sessionSet = append(c.sessionSet, name)
+		c.changes = append(c.changes, adjust)
+	}
+}
+
+// WithOptions starts from a copy of opts, as parsed from the command line.
+// The other options adjust the copy, whether they are given before or after it.
+func WithOptions(opts *models.Options) ClientOption {
+	return func(c *Client) {
+		if opts != nil {
+			copied := *opts
+			c.base = &copied
+		}
+	}
+}
+
+// WithRateLimit caps the combined download speed of the Client's requests, in bytes per second (0 means no limit)
+func WithRateLimit(bytesPerSecond int64) ClientOption {
+	return sessionChange("WithRateLimit", func(opts *models.Options) {
+		opts.RateLimit = ""
+		if bytesPerSecond > 0 {
+			opts.RateLimit = strconv.FormatInt(bytesPerSecond, 10)
+		}
+	})
+}
+
+// WithHostRateLimit caps the combined download speed of requests to host, on top of WithRateLimit
+func WithHostRateLimit(host string, bytesPerSecond int64) ClientOption {
+	return sessionChange("WithHostRateLimit", func(opts *models.Options) {
+		opts.HostRateLimits = append(slices.Clip(opts.HostRateLimits), host+"="+strconv.FormatInt(bytesPerSecond, 10))
+	})
+}
+
+// WithRetries makes up to tries attempts per download, waiting at most maxWait between them
+func WithRetries(tries int, maxWait time.Duration) ClientOption {
+	return change(func(opts *models.Options) {
+		opts.Tries = tries
+		opts.WaitRetry = maxWait
+	})
+}
+
+// WithTimeout gives up on connections that get no answer or data for d
+func WithTimeout(d time.Duration) ClientOption {
+	return sessionChange("WithTimeout", func(opts *models.Options) {
+		opts.Timeout = d
+	})
+}
+
+// WithHeader adds a header to every request
+func WithHeader(name, value string) ClientOption {
+	return change(func(opts *models.Options) {
+		// Clipped so the options WithOptions copied from keep their own headers
+		opts.Headers = append(slices.Clip(opts.Headers), name+": "+value)
+	})
+}
+
+// WithUserAgent sets the User-Agent sent with every request
+func WithUserAgent(userAgent string) ClientOption {
+	return change(func(opts *models.Options) {
+		opts.UserAgent = userAgent
+	})
+}
+
+// WithBasicAuth sets the credentials for Basic and Digest authentication (and FTP logins)
+func WithBasicAuth(user, password string) ClientOption {
+	return sessionChange("WithBasicAuth", func(opts *models.Options) {
+		opts.User = user
+		opts.Password = password
+	})
+}
+
+// WithBearerToken sends "Authorization: Bearer <token>" to the hosts of the requests
+func WithBearerToken(token string) ClientOption {
+	return sessionChange("WithBearerToken", func(opts *models.Options) {
+		opts.BearerToken = token
+	})
+}
+
+// WithProxy sends requests through an HTTP or socks5:// proxy
+func WithProxy(proxyURL string) ClientOption {
+	return sessionChange("WithProxy", func(opts *models.Options) {
+		opts.Proxy = proxyURL
+	})
+}
+
+// WithConcurrency sets how many downloads DoAll runs at once
+func WithConcurrency(n int) ClientOption {
+	return func(c *Client) {
+		c.concurrency = n
+	}
+}
+
+// WithSession sends the requests through an existing session, sharing its cookies, credentials,
+// rate limits, timeouts and proxy, which can't be changed with other options then. Without
+// WithOptions, the downloads start from the options the session was created with.
+// The Client leaves closing the session to its owner.
+func WithSession(session *Session) ClientOption {
+	return func(c *Client) {
+		c.session = session
+	}
+}
+
+// WithEventHandler reports the progress and outcome of every download to handler
+func WithEventHandler(handler EventHandler) ClientOption {
+	return func(c *Client) {
+		c.handler = handler
+	}
+}
+
+// WithOutput prints wget style messages and a progress bar to w, like the command line does
+func WithOutput(w io.Writer) ClientOption {
+	return func(c *Client) {
+		c.output = w
+	}
+}
+
+// NewClient creates a Client. Without options it downloads with wget's defaults.
+func NewClient(options ...ClientOption) (*Client, error) {
+	c := &Client{concurrency: 1}
+	for _, option := range options {
+		option(c)
+	}
+	if c.session != nil && len(c.sessionSet) > 0 {
+		return nil, fmt.Errorf("%s can't change a session given with WithSession", strings.Join(c.sessionSet, ", "))
+	}
+
+	// Adjust the options WithOptions started from, wherever it was given
+	switch {
+	case c.base != nil:
+		c.opts = c.base
+	case c.session != nil:
+		copied := *c.session.opts
+		c.opts = &copied
+	default:
+		c.opts = models.NewOptions()
+	}
+	c.base = nil
+	for _, adjust := range c.changes {
+		adjust(c.opts)
+	}
+	c.changes = nil
+	if c.concurrency < 1 {
+		c.concurrency = 1
+	}
+	if c.session != nil {
+		return c, nil
+	}
+
+	session, err := NewSession(c.opts)
+	if err != nil {
+		return nil, err
+	}
+	c.session = session
+	c.ownSession = true
+	return c, nil
+}
+
+// Session returns the session the Client sends its requests through
+func (c *Client) Session() *Session {
+	return c.session
+}
+
+// Close saves the cookies if the options ask for it, unless the session came from WithSession
+func (c *Client) Close() error {
+	if !c.ownSession {
+		return nil
+	}
+	return c.session.Close()
+}
+
+// Do downloads a single file, retrying transient failures. The returned error is also
+// in the Response, which is never nil.
+func (c *Client) Do(ctx context.Context, req *Request) (*Response, error) {
+	t, err := c.newTransfer(ctx, req)
+	if err != nil {
+		return &Response{URL: req.URL, Err: err}, err
+	}
+	resp := c.run(t)
+	return resp, resp.Err
+}
+
+// DoAll downloads the files concurrently, returning their responses in the order of reqs.
+// Once ctx is cancelled the downloads in flight stop, keeping their .part files, and the
+// remaining ones fail with ctx's error without being started.
+func (c *Client) DoAll(ctx context.Context, reqs []*Request) []*Response {
+	responses := make([]*Response, len(reqs))
+	jobs := make(chan int, len(reqs))
+	transfers := make([]*transfer, len(reqs))
+
+	partNames := make(map[string]int)
+	for i, req := range reqs {
+		t, err := c.newTransfer(ctx, req)
+		if err != nil {
+			responses[i] = &Response{URL: req.URL, Err: err}
+			continue
+		}
+
+		// Requests sharing a file name still need their own .part file while they download side by side
+		if t.sink == nil {
+			if n := partNames[t.outputPath]; n > 0 {
+				t.part = fmt.Sprintf("%s.%d.part", t.outputPath, n)
+			}
+			partNames[t.outputPath]++
+		}
+
+		transfers[i] = t
+		jobs <- i
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	for i := 0; i < c.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				responses[i] = c.run(transfers[i])
+			}
+		}()
+	}
+	wg.Wait()
+	return responses
+}
+
+// newTransfer prepares the transfer for a request
+func (c *Client) newTransfer(ctx context.Context, req *Request) (*transfer, error) {
+	outputPath := req.OutputPath
+	if outputPath == "" && req.Writer == nil {
+		filename, err := FilenameFromURL(req.URL)
+		if err != nil {
+			return nil, err
+		}
+		outputPath = filepath.Join(req.Dir, filename)
+	}
+
+	output := c.output
+	if output == nil {
+		output = io.Discard
+	}
+	t := newTransfer(ctx, c.session, c.opts, req.URL, outputPath, c.output != nil, output)
+	t.checksum = req.Checksum
+	t.sink = req.Writer
+	t.events = c.handler
+	return t, nil
+}
+
+// run performs a transfer and describes its outcome
+func (c *Client) run(t *transfer) *Response {
+	start := time.Now()
+	result := t.run()
+	return &Response{
+		URL:        result.URL,
+		OutputPath: result.OutputPath,
+		Size:       result.Size,
+		Attempts:   result.Attempts,
+		Skipped:    result.Skipped,
+		Duration:   time.Since(start),
+		Err:        result.Error,
+	}
+}
+
+// result converts a Response into the Result reported by ConcurrentDownloader
+func (r *Response) result() Result {
+	return Result{
+		URL:        r.URL,
+		Success:    r.Err == nil,
+		Error:      r.Err,
+		Size:       r.Size,
+		OutputPath: r.OutputPath,
+		Attempts:   r.Attempts,
+		Skipped:    r.Skipped,
+	}
+}
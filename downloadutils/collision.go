@@ -0,0 +1,54 @@
+package downloadutils
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// finalizeMu serializes picking a final name and renaming into it,
+// so concurrent downloads of files with the same name don't race
+var finalizeMu sync.Mutex
+
+// fileExists reports whether something already exists at path
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// NextFreeName returns path if nothing exists there yet, otherwise the first
+// wget-style numbered name (path.1, path.2, ...) that is still free
+func NextFreeName(path string) string {
+	if !fileExists(path) {
+		return path
+	}
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s.%d", path, n)
+		if !fileExists(candidate) {
+			return candidate
+		}
+	}
+}
+
+// RotateBackups moves an existing file out of the way before it is replaced,
+// keeping up to backups old copies as path.1 (newest) through path.N (oldest)
+func RotateBackups(path string, backups int) error {
+	if backups < 1 || !fileExists(path) {
+		return nil
+	}
+
+	// Shift the older copies up by one, dropping the oldest
+	for n := backups - 1; n >= 1; n-- {
+		older := fmt.Sprintf("%s.%d", path, n)
+		if fileExists(older) {
+			if err := os.Rename(older, fmt.Sprintf("%s.%d", path, n+1)); err != nil {
+				return &IOError{fmt.Errorf("failed to rotate backup %s: %v", older, err)}
+			}
+		}
+	}
+
+	if err := os.Rename(path, path+".1"); err != nil {
+		return &IOError{fmt.Errorf("failed to back up %s: %v", path, err)}
+	}
+	return nil
+}
@@ -1,12 +1,14 @@
 package downloadutils
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"net/url"
-	"path/filepath"
+	"os"
 	"strings"
-	"sync"
+	"wget/models"
 )
 
 // Result represents the result of a download
@@ -16,29 +18,51 @@ type Result struct {
 	Error      error
 	Size       int64
 	OutputPath string
+	Attempts   int
+	Skipped    bool // The file already existed and was kept (--no-clobber)
 }
 
 // ConcurrentDownloader manages concurrent downloads
 type ConcurrentDownloader struct {
 	concurrency int
 	outputPath  string
-	rateLimit   string
+	opts        *models.Options
+	checksums   map[string]string // Expected checksum per URL
 }
 
 // NewConcurrentDownloader creates a new ConcurrentDownloader instance
-func NewConcurrentDownloader(concurrency int, outputPath string, rateLimit string) *ConcurrentDownloader {
+func NewConcurrentDownloader(concurrency int, outputPath string, opts *models.Options) *ConcurrentDownloader {
 	return &ConcurrentDownloader{
 		concurrency: concurrency,
 		outputPath:  outputPath,
-		rateLimit:   rateLimit,
+		opts:        opts,
 	}
 }
 
+// SetChecksums sets the expected checksum (e.g., "sha256:<hex>") for each URL
+func (d *ConcurrentDownloader) SetChecksums(checksums map[string]string) {
+	d.checksums = checksums
+}
+
 // getContentSizes fetches the content sizes for all URLs
-func (d *ConcurrentDownloader) getContentSizes(urls []string) []int64 {
+func (d *ConcurrentDownloader) getContentSizes(ctx context.Context, session *Session, urls []string) []int64 {
 	var sizes []int64
 	for _, urlStr := range urls {
-		resp, err := http.Head(urlStr)
+		// Other schemes are asked for their size where that's cheap (e.g., FTP's SIZE), and
+		// left unknown where it would take a fetch
+		if !isHTTP(urlStr) {
+			t := newTransfer(ctx, session, session.opts, urlStr, "", false, io.Discard)
+			sizes = append(sizes, max(t.statSize(ctx), 0))
+			continue
+		}
+
+		req, err := NewRequest(http.MethodHead, urlStr, nil, d.opts)
+		if err != nil {
+			sizes = append(sizes, 0)
+			continue
+		}
+		req = req.WithContext(ctx)
+		resp, err := session.Do(req)
 		if err != nil {
 			sizes = append(sizes, 0)
 			continue
@@ -49,10 +73,39 @@ func (d *ConcurrentDownloader) getContentSizes(urls []string) []int64 {
 	return sizes
 }
 
-// DownloadURLs downloads multiple URLs concurrently
-func (d *ConcurrentDownloader) DownloadURLs(urls []string) []Result {
+// DownloadURLs downloads multiple URLs concurrently. Once ctx is cancelled the downloads
+// in flight stop, keeping their .part files, and the remaining ones are not started.
+func (d *ConcurrentDownloader) DownloadURLs(ctx context.Context, urls []string) []Result {
+	// All downloads share one client (and cookie jar), their events drive the display
+	var display *MultiProgress
+	client, err := NewClient(WithOptions(d.opts), WithConcurrency(d.concurrency), WithEventHandler(func(e Event) {
+		display.Handle(e)
+	}))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		resultsList := make([]Result, 0, len(urls))
+		for _, urlStr := range urls {
+			resultsList = append(resultsList, Result{URL: urlStr, Error: err})
+		}
+		return resultsList
+	}
+	defer func() {
+		if err := client.Close(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}()
+	session := client.Session()
+
+	// FTP glob patterns and directories stand for the files they match
+	urls, failed := expandFTP(ctx, session, urls)
+
+	// Every listed URL may receive the credentials, even for the size probes
+	for _, urlStr := range urls {
+		session.AuthorizeHost(urlStr)
+	}
+
 	// Get content sizes first
-	sizes := d.getContentSizes(urls)
+	sizes := d.getContentSizes(ctx, session, urls)
 	fmt.Printf("content size: [")
 	for i, size := range sizes {
 		if i > 0 {
@@ -62,88 +115,69 @@ func (d *ConcurrentDownloader) DownloadURLs(urls []string) []Result {
 	}
 	fmt.Printf("]\n")
 
-	// Create channels for URLs and results
-	urlChan := make(chan string, len(urls))
-	results := make(chan Result, len(urls))
-	var wg sync.WaitGroup
-
-	// Start worker goroutines
-	for i := 0; i < d.concurrency; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for urlStr := range urlChan {
-				// Parse URL to get filename
-				parsedURL, err := url.Parse(urlStr)
-				if err != nil {
-					results <- Result{
-						URL:     urlStr,
-						Success: false,
-						Error:   fmt.Errorf("invalid URL: %v", err),
-					}
-					continue
-				}
-
-				// Get filename from URL
-				fileName := filepath.Base(parsedURL.Path)
-				if fileName == "" || fileName == "." || fileName == "/" {
-					fileName = "index.html"
-				}
-
-				// Clean filename
-				fileName = strings.Map(func(r rune) rune {
-					if strings.ContainsRune(`<>:"/\|?*`, r) {
-						return '_'
-					}
-					return r
-				}, fileName)
-
-				// Create output path
-				outputPath := filepath.Join(d.outputPath, fileName)
-
-				// Download the file
-				err = DownloadFileSilent(urlStr, outputPath, d.rateLimit)
-				result := Result{
-					URL:        urlStr,
-					Success:    err == nil,
-					Error:      err,
-					OutputPath: outputPath,
-				}
-				results <- result
-
-				if err == nil {
-					fmt.Printf("finished %s\n", fileName)
-				}
-			}
-		}()
+	// A live line per active download and a total, or plain lines when stdout isn't a terminal
+	var totalBytes int64
+	for _, size := range sizes {
+		if size <= 0 {
+			totalBytes = 0
+			break
+		}
+		totalBytes += size
 	}
+	display = NewMultiProgress(os.Stdout, len(urls), totalBytes)
 
-	// Send URLs to workers
+	reqs := make([]*Request, 0, len(urls))
 	for _, urlStr := range urls {
-		urlChan <- urlStr
+		reqs = append(reqs, &Request{URL: urlStr, Dir: d.outputPath, Checksum: d.checksums[urlStr]})
 	}
-	close(urlChan)
-
-	// Wait for all downloads to complete
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
 
 	// Collect results
-	var resultsList []Result
+	resultsList := failed
+	for _, result := range failed {
+		fmt.Printf("Error downloading %s: %v\n", result.URL, result.Error)
+	}
 	var successfulURLs []string
-	for result := range results {
-		if result.Error != nil {
-			fmt.Printf("Error downloading %s: %v\n", result.URL, result.Error)
-		} else {
-			successfulURLs = append(successfulURLs, result.URL)
+	var limitErr *LimitError
+	responses := client.DoAll(ctx, reqs)
+	display.Stop()
+	for _, resp := range responses {
+		switch {
+		case errors.Is(resp.Err, context.Canceled):
+			// Interrupted, not worth an error line per file
+		case errors.As(resp.Err, &limitErr):
+			// Listed in the report of skipped files below
+		case resp.Err != nil:
+			fmt.Printf("Error downloading %s: %v\n", resp.URL, resp.Err)
+		default:
+			successfulURLs = append(successfulURLs, resp.URL)
+		}
+		resultsList = append(resultsList, resp.result())
+	}
+
+	// Verify against (or write) the checksum manifest, unless interrupted: a manifest
+	// of the files finished so far would be taken as the reference by the next run
+	if d.opts != nil && d.opts.ChecksumManifest != "" && ctx.Err() == nil {
+		if err := applyManifest(d.opts.ChecksumManifest, resultsList); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			// Files that couldn't be checked don't count as good downloads
+			for i := range resultsList {
+				if resultsList[i].Success {
+					resultsList[i].Success = false
+					resultsList[i].Error = err
+				}
+			}
+		}
+		successfulURLs = successfulURLs[:0]
+		for _, result := range resultsList {
+			if result.Success {
+				successfulURLs = append(successfulURLs, result.URL)
+			}
 		}
-		resultsList = append(resultsList, result)
 	}
 
 	// Print final summary
 	fmt.Printf("\nDownload finished: [%s]\n", strings.Join(successfulURLs, " "))
+	session.ReportSkipped(os.Stdout)
 
 	return resultsList
 }
@@ -0,0 +1,254 @@
+package downloadutils
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// cookieEntry is one line of a Netscape cookies.txt file
+type cookieEntry struct {
+	domain     string // Host name, with a leading dot for domain cookies
+	subdomains bool   // Whether the cookie is also sent to subdomains
+	path       string
+	secure     bool
+	httpOnly   bool
+	expires    time.Time // Zero for session cookies
+	name       string
+	value      string
+}
+
+// key identifies the cookie the way browsers do: by domain, path and name
+func (e *cookieEntry) key() string {
+	return e.domain + "\t" + e.path + "\t" + e.name
+}
+
+// CookieJar is an http.CookieJar that can also load and save Netscape cookies.txt files.
+// The standard library jar does the matching; we keep our own copy of every cookie so it can be saved.
+type CookieJar struct {
+	jar     *cookiejar.Jar
+	mu      sync.Mutex
+	entries map[string]*cookieEntry
+}
+
+// NewCookieJar creates an empty cookie jar
+func NewCookieJar() (*CookieJar, error) {
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cookie jar: %v", err)
+	}
+	return &CookieJar{jar: jar, entries: make(map[string]*cookieEntry)}, nil
+}
+
+// Cookies implements http.CookieJar
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+// SetCookies implements http.CookieJar, remembering the cookies for Save
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	for _, c := range cookies {
+		domain, subdomains, ok := cookieDomain(u.Hostname(), c.Domain)
+		if !ok {
+			// Rejected by the jar too, it must not reach the saved file either
+			continue
+		}
+		entry := &cookieEntry{
+			domain:     domain,
+			subdomains: subdomains,
+			path:       c.Path,
+			secure:     c.Secure,
+			httpOnly:   c.HttpOnly,
+			name:       c.Name,
+			value:      c.Value,
+		}
+		if entry.path == "" || !strings.HasPrefix(entry.path, "/") {
+			entry.path = defaultCookiePath(u.Path)
+		}
+
+		// Max-Age wins over Expires; either one in the past deletes the cookie
+		switch {
+		case c.MaxAge < 0:
+			delete(j.entries, entry.key())
+			continue
+		case c.MaxAge > 0:
+			entry.expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		case !c.Expires.IsZero():
+			if !c.Expires.After(now) {
+				delete(j.entries, entry.key())
+				continue
+			}
+			entry.expires = c.Expires
+		}
+		j.entries[entry.key()] = entry
+	}
+}
+
+// cookieDomain checks the Domain attribute of a cookie set by host the way the standard library
+// jar does, and returns the domain to save it under and whether it is sent to subdomains.
+// A domain that host doesn't belong to, or a public suffix like "com", is rejected.
+func cookieDomain(host, domain string) (string, bool, bool) {
+	host = strings.ToLower(host)
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	if domain == "" {
+		return host, false, true
+	}
+	if net.ParseIP(host) != nil {
+		// IP addresses only get host cookies
+		return host, false, domain == host
+	}
+	if strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", false, false
+	}
+	if publicsuffix.List.PublicSuffix(domain) == domain {
+		// Allowed for the suffix's own host only, as a host cookie
+		return host, false, host == domain
+	}
+	if host != domain && !strings.HasSuffix(host, "."+domain) {
+		return "", false, false
+	}
+	return "." + domain, true, true
+}
+
+// defaultCookiePath returns the default cookie path for a request path (RFC 6265 section 5.1.4)
+func defaultCookiePath(requestPath string) string {
+	if requestPath == "" || requestPath[0] != '/' || strings.Count(requestPath, "/") == 1 {
+		return "/"
+	}
+	return path.Dir(requestPath)
+}
+
+// Load reads cookies from a Netscape cookies.txt file into the jar
+func (j *CookieJar) Load(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return &IOError{fmt.Errorf("failed to open cookies file: %v", err)}
+	}
+	defer file.Close()
+
+	now := time.Now()
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		// HttpOnly cookies are written as comments with a special prefix
+		httpOnly := false
+		if rest, ok := strings.CutPrefix(line, "#HttpOnly_"); ok {
+			line = rest
+			httpOnly = true
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return &ParseError{fmt.Errorf("invalid cookie on line %d of %s", lineNum, filename)}
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return &ParseError{fmt.Errorf("invalid cookie expiry on line %d of %s", lineNum, filename)}
+		}
+
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		if expires > 0 {
+			cookie.Expires = time.Unix(expires, 0)
+			if !cookie.Expires.After(now) {
+				continue
+			}
+		}
+
+		host := strings.TrimPrefix(fields[0], ".")
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = host
+		}
+
+		scheme := "http"
+		if cookie.Secure {
+			scheme = "https"
+		}
+		j.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: cookie.Path}, []*http.Cookie{cookie})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return &IOError{fmt.Errorf("failed to read cookies file: %v", err)}
+	}
+	return nil
+}
+
+// Save writes the jar's cookies to a Netscape cookies.txt file.
+// Session cookies (without an expiry) are only written when keepSession is set.
+func (j *CookieJar) Save(filename string, keepSession bool) error {
+	j.mu.Lock()
+	entries := make([]*cookieEntry, 0, len(j.entries))
+	now := time.Now()
+	for _, entry := range j.entries {
+		if entry.expires.IsZero() && !keepSession {
+			continue
+		}
+		if !entry.expires.IsZero() && !entry.expires.After(now) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	j.mu.Unlock()
+
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].key() < entries[b].key()
+	})
+
+	var b strings.Builder
+	b.WriteString("# Netscape HTTP Cookie File\n# Generated by wget. Edit at your own risk.\n\n")
+	for _, entry := range entries {
+		if entry.httpOnly {
+			b.WriteString("#HttpOnly_")
+		}
+		var expires int64
+		if !entry.expires.IsZero() {
+			expires = entry.expires.Unix()
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			entry.domain,
+			netscapeBool(entry.subdomains),
+			entry.path,
+			netscapeBool(entry.secure),
+			expires,
+			entry.name,
+			entry.value,
+		)
+	}
+
+	return WriteFileAtomic(filename, []byte(b.String()), 0o600)
+}
+
+// netscapeBool formats a flag the way cookies.txt expects
+func netscapeBool(b bool) string {
+	if b {
+		return "TRUE"
+	}
+	return "FALSE"
+}
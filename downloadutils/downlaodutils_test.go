@@ -1,17 +1,39 @@
 package downloadutils
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"wget/models"
 )
 
 // MockDownloadFileSilent is a mock function to replace DownloadFileSilent for testing
@@ -33,8 +55,8 @@ func TestDownloadURLs(t *testing.T) {
 	// Create a ConcurrentDownloader instance without the mock function
 	downloader := &ConcurrentDownloader{
 		outputPath:  outputDir,
-		rateLimit:   "300000", // 300k limit for testing
-		concurrency: 2,        // Set concurrency level
+		opts:        &models.Options{RateLimit: "300000"}, // 300k limit for testing
+		concurrency: 2,                                    // Set concurrency level
 	}
 
 	tests := []struct {
@@ -64,7 +86,7 @@ func TestDownloadURLs(t *testing.T) {
 			// Use the mock function directly in the test
 			for _, urlStr := range tt.urls {
 				outputPath := filepath.Join(outputDir, filepath.Base(urlStr))
-				err := MockDownloadFileSilent(urlStr, outputPath, downloader.rateLimit)
+				err := MockDownloadFileSilent(urlStr, outputPath, downloader.opts.RateLimit)
 				if (err == nil) != (urlStr == "http://example.com/valid") {
 					t.Errorf("expected download success for %s, got error: %v", urlStr, err)
 				}
@@ -128,7 +150,7 @@ func TestDownloadFileWithProgress(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := downloadFileWithProgress(tt.url, tt.outputPath, tt.rateLimit, tt.showProgress, os.Stdout)
+			err := downloadFileWithProgress(context.Background(), tt.url, tt.outputPath, &models.Options{RateLimit: tt.rateLimit}, tt.showProgress, os.Stdout)
 
 			if (err != nil) != tt.expectError {
 				t.Errorf("expected error: %v, got: %v", tt.expectError, err)
@@ -285,31 +307,27 @@ func TestRateLimitedReader_Read(t *testing.T) {
 	tests := []struct {
 		name           string
 		rateLimit      int64
-		windowSize     time.Duration
 		inputData      []byte
 		readSize       int
 		expectedOutput []byte
 	}{
 		{
 			name:           "Read within rate limit",
-			rateLimit:      10,
-			windowSize:     1 * time.Second,
+			rateLimit:      100,
 			inputData:      []byte("HelloWorld"), // 10 bytes
 			readSize:       5,
 			expectedOutput: []byte("Hello"), // Expect to read 5 bytes
 		},
 		{
 			name:           "Exceed rate limit",
-			rateLimit:      5,
-			windowSize:     1 * time.Second,
+			rateLimit:      50,
 			inputData:      []byte("HelloWorld"), // 10 bytes
 			readSize:       10,
-			expectedOutput: []byte("Hello"), // Expect to read only 5 bytes and wait
+			expectedOutput: []byte("Hello"), // Expect to read only a tenth of a second's worth
 		},
 		{
 			name:           "Read zero bytes",
-			rateLimit:      10,
-			windowSize:     1 * time.Second,
+			rateLimit:      100,
 			inputData:      []byte("HelloWorld"), // 10 bytes
 			readSize:       0,
 			expectedOutput: []byte(""), // Expect to read 0 bytes
@@ -319,11 +337,7 @@ func TestRateLimitedReader_Read(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			mockReader := &MockReader{data: tt.inputData}
-			rlReader := &RateLimitedReader{
-				reader:     mockReader,
-				rateLimit:  tt.rateLimit,
-				windowSize: tt.windowSize,
-			}
+			rlReader := NewRateLimitedReader(mockReader, tt.rateLimit)
 
 			output := make([]byte, tt.readSize)
 			n, err := rlReader.Read(output)
@@ -342,3 +356,2893 @@ func TestRateLimitedReader_Read(t *testing.T) {
 		})
 	}
 }
+
+// TestDownloadFileContinue tests resuming a partial download with -c
+func TestDownloadFileContinue(t *testing.T) {
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	tests := []struct {
+		name        string
+		partial     []byte
+		ignoreRange bool
+	}{
+		{name: "Resume partial file", partial: content[:10]},
+		{name: "Server ignores Range", partial: content[:10], ignoreRange: true},
+		{name: "Already complete", partial: content},
+		{name: "Nothing downloaded yet", partial: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.ignoreRange {
+					r.Header.Del("Range")
+				}
+				http.ServeContent(w, r, "file.txt", time.Time{}, bytes.NewReader(content))
+			}))
+			defer mockServer.Close()
+
+			outputPath := filepath.Join(t.TempDir(), "file.txt")
+			if tt.partial != nil {
+				if err := os.WriteFile(outputPath, tt.partial, 0o644); err != nil {
+					t.Fatalf("failed to write partial file: %v", err)
+				}
+			}
+
+			err := downloadFileWithProgress(context.Background(), mockServer.URL, outputPath, &models.Options{Continue: true}, false, os.Stdout)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			got, err := os.ReadFile(outputPath)
+			if err != nil {
+				t.Fatalf("failed to read downloaded file: %v", err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("expected content %q, got %q", content, got)
+			}
+		})
+	}
+}
+
+// TestParseContentRange tests the parseContentRange function
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header string
+		start  int64
+		total  int64
+		err    bool
+	}{
+		{"bytes 100-199/200", 100, 200, false},
+		{"bytes 0-9/*", 0, -1, false},
+		{"bytes */500", -1, 500, false},
+		{"items 0-9/10", 0, 0, true},
+		{"bytes abc-9/10", 0, 0, true},
+	}
+
+	for _, test := range tests {
+		start, total, err := parseContentRange(test.header)
+		if (err != nil) != test.err {
+			t.Errorf("parseContentRange(%q) error = %v, wantErr %v", test.header, err, test.err)
+			continue
+		}
+		if !test.err && (start != test.start || total != test.total) {
+			t.Errorf("parseContentRange(%q) = %d, %d, want %d, %d", test.header, start, total, test.start, test.total)
+		}
+	}
+}
+
+// TestDownloadRetries tests that transient failures are retried and counted
+func TestDownloadRetries(t *testing.T) {
+	tests := []struct {
+		name             string
+		failures         int
+		failStatus       int
+		tries            int
+		retryOn          []int
+		expectSuccess    bool
+		expectedAttempts int
+	}{
+		{name: "Recovers from 503", failures: 2, failStatus: http.StatusServiceUnavailable, tries: 3, expectSuccess: true, expectedAttempts: 3},
+		{name: "Gives up after tries", failures: 5, failStatus: http.StatusBadGateway, tries: 2, expectSuccess: false, expectedAttempts: 2},
+		{name: "404 is final", failures: 1, failStatus: http.StatusNotFound, tries: 3, expectSuccess: false, expectedAttempts: 1},
+		{name: "Retry on extra status", failures: 1, failStatus: http.StatusNotFound, tries: 3, retryOn: []int{404}, expectSuccess: true, expectedAttempts: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests <= tt.failures {
+					w.Header().Set("Retry-After", "0")
+					w.WriteHeader(tt.failStatus)
+					return
+				}
+				_, _ = w.Write([]byte("ok"))
+			}))
+			defer mockServer.Close()
+
+			opts := &models.Options{Tries: tt.tries, WaitRetry: 10 * time.Millisecond, RetryOnHTTPError: tt.retryOn}
+			result := download(context.Background(), mockServer.URL, filepath.Join(t.TempDir(), "file.txt"), opts, false, os.Stdout)
+
+			if result.Success != tt.expectSuccess {
+				t.Errorf("expected success %v, got error %v", tt.expectSuccess, result.Error)
+			}
+			if result.Attempts != tt.expectedAttempts {
+				t.Errorf("expected %d attempts, got %d", tt.expectedAttempts, result.Attempts)
+			}
+		})
+	}
+}
+
+// TestParseRetryAfter tests the parseRetryAfter function
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 8, 19, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		header   string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-5", 0},
+		{"Wed, 08 Jan 2025 19:00:30 GMT", 30 * time.Second},
+		{"Wed, 08 Jan 2025 18:00:00 GMT", 0},
+		{"soon", 0},
+	}
+
+	for _, test := range tests {
+		if got := parseRetryAfter(test.header, now); got != test.expected {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", test.header, got, test.expected)
+		}
+	}
+}
+
+// TestRetryDelay tests that the backoff grows, stays within the cap and honors Retry-After
+func TestRetryDelay(t *testing.T) {
+	for attempt := 1; attempt <= 6; attempt++ {
+		delay := retryDelay(attempt, 8*time.Second, fmt.Errorf("connection reset"))
+		ceiling := min(time.Second<<(attempt-1), 8*time.Second)
+		if delay < ceiling/2 || delay > ceiling {
+			t.Errorf("retryDelay(%d) = %v, want between %v and %v", attempt, delay, ceiling/2, ceiling)
+		}
+	}
+
+	statusErr := &HTTPError{Status: "503 Service Unavailable", StatusCode: 503, RetryAfter: 5 * time.Second}
+	if delay := retryDelay(1, 8*time.Second, statusErr); delay != 5*time.Second {
+		t.Errorf("retryDelay with Retry-After = %v, want 5s", delay)
+	}
+
+	// A server can't stall the run past --waitretry
+	statusErr.RetryAfter = 24 * time.Hour
+	if delay := retryDelay(1, 8*time.Second, statusErr); delay != 8*time.Second {
+		t.Errorf("retryDelay with a day's Retry-After = %v, want 8s", delay)
+	}
+	if delay := retryDelay(1, 0, statusErr); delay != defaultWaitRetry {
+		t.Errorf("retryDelay with a day's Retry-After and no --waitretry = %v, want %v", delay, defaultWaitRetry)
+	}
+}
+
+// TestSegmentedDownload tests splitting a download into parallel byte ranges
+func TestSegmentedDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+
+	tests := []struct {
+		name           string
+		acceptRanges   bool
+		expectedRanges int
+	}{
+		{name: "Server supports ranges", acceptRanges: true, expectedRanges: 4},
+		{name: "Falls back to single stream", acceptRanges: false, expectedRanges: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			ranges := 0
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !tt.acceptRanges {
+					_, _ = w.Write(content)
+					return
+				}
+				if r.Header.Get("Range") != "" {
+					mu.Lock()
+					ranges++
+					mu.Unlock()
+				}
+				http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+			}))
+			defer mockServer.Close()
+
+			outputPath := filepath.Join(t.TempDir(), "file.bin")
+			result := download(context.Background(), mockServer.URL, outputPath, &models.Options{Segments: 4}, false, os.Stdout)
+			if result.Error != nil {
+				t.Fatalf("expected no error, got %v", result.Error)
+			}
+
+			got, err := os.ReadFile(outputPath)
+			if err != nil {
+				t.Fatalf("failed to read downloaded file: %v", err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("downloaded content does not match")
+			}
+			if ranges != tt.expectedRanges {
+				t.Errorf("expected %d range requests, got %d", tt.expectedRanges, ranges)
+			}
+			if result.Size != int64(len(content)) {
+				t.Errorf("expected size %d, got %d", len(content), result.Size)
+			}
+		})
+	}
+}
+
+// TestSplitSegments tests the splitSegments function
+func TestSplitSegments(t *testing.T) {
+	tests := []struct {
+		size     int64
+		n        int
+		expected [][2]int64
+	}{
+		{10, 2, [][2]int64{{0, 4}, {5, 9}}},
+		{10, 3, [][2]int64{{0, 2}, {3, 5}, {6, 9}}},
+		{2, 4, [][2]int64{{0, 0}, {1, 1}}},
+	}
+
+	for _, test := range tests {
+		segments := splitSegments(test.size, test.n)
+		if len(segments) != len(test.expected) {
+			t.Errorf("splitSegments(%d, %d) returned %d segments, want %d", test.size, test.n, len(segments), len(test.expected))
+			continue
+		}
+		for i, seg := range segments {
+			if seg.start != test.expected[i][0] || seg.end != test.expected[i][1] {
+				t.Errorf("splitSegments(%d, %d)[%d] = %d-%d, want %d-%d", test.size, test.n, i, seg.start, seg.end, test.expected[i][0], test.expected[i][1])
+			}
+		}
+	}
+}
+
+// TestDownloadChecksum tests verifying a download against --checksum
+func TestDownloadChecksum(t *testing.T) {
+	content := []byte("This is a test file content.")
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	}))
+	defer mockServer.Close()
+
+	tests := []struct {
+		name        string
+		checksum    string
+		expectError bool
+		expectFile  bool
+	}{
+		{name: "Matching sha256", checksum: fmt.Sprintf("sha256:%x", sha256.Sum256(content)), expectError: false, expectFile: true},
+		{name: "Matching md5", checksum: fmt.Sprintf("md5:%x", md5.Sum(content)), expectError: false, expectFile: true},
+		{name: "Mismatching sha256", checksum: "sha256:b44f8ca6c0ff0ae7ee5d2d3fd5a7c47a2ff1a4e0d6b0aef8cb2d1e1ee47e2a4a", expectError: true, expectFile: false},
+		{name: "Invalid spec", checksum: "crc32:1234", expectError: true, expectFile: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputPath := filepath.Join(t.TempDir(), "file.txt")
+			err := downloadFileWithProgress(context.Background(), mockServer.URL, outputPath, &models.Options{Checksum: tt.checksum}, false, os.Stdout)
+			if (err != nil) != tt.expectError {
+				t.Errorf("expected error: %v, got: %v", tt.expectError, err)
+			}
+			if _, statErr := os.Stat(outputPath); (statErr == nil) != tt.expectFile {
+				t.Errorf("expected file to exist: %v, got stat error: %v", tt.expectFile, statErr)
+			}
+			if _, statErr := os.Stat(outputPath + ".part"); statErr == nil {
+				t.Errorf("expected no .part file to be left")
+			}
+		})
+	}
+
+	// A complete file left by an earlier download fails the check but stays, only .part files get deleted
+	rangeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.txt", time.Time{}, bytes.NewReader(content))
+	}))
+	defer rangeServer.Close()
+	outputPath := filepath.Join(t.TempDir(), "file.txt")
+	mine := bytes.Repeat([]byte("m"), len(content))
+	os.WriteFile(outputPath, mine, 0o644)
+	opts := &models.Options{Checksum: fmt.Sprintf("sha256:%x", sha256.Sum256(content)), Continue: true}
+	var checksumErr *ChecksumError
+	if err := downloadFileWithProgress(context.Background(), rangeServer.URL, outputPath, opts, false, os.Stdout); !errors.As(err, &checksumErr) {
+		t.Errorf("expected a ChecksumError, got %v", err)
+	}
+	if got, _ := os.ReadFile(outputPath); !bytes.Equal(got, mine) {
+		t.Errorf("expected the existing file to be kept, got %q", got)
+	}
+}
+
+// TestChecksumManifest tests writing a manifest and then verifying against it
+func TestChecksumManifest(t *testing.T) {
+	content := "original"
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(content + r.URL.Path))
+	}))
+	defer mockServer.Close()
+
+	outputDir := t.TempDir()
+	manifestPath := filepath.Join(outputDir, "SHA256SUMS")
+	urls := []string{mockServer.URL + "/a.txt", mockServer.URL + "/b.txt"}
+	downloader := NewConcurrentDownloader(2, outputDir, &models.Options{ChecksumManifest: manifestPath})
+
+	// First run writes the manifest
+	for _, result := range downloader.DownloadURLs(context.Background(), urls) {
+		if !result.Success {
+			t.Fatalf("expected %s to succeed, got %v", result.URL, result.Error)
+		}
+	}
+	manifest, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatalf("expected manifest to be written: %v", err)
+	}
+	if !bytes.Contains(manifest, []byte("  a.txt\n")) || !bytes.Contains(manifest, []byte("  b.txt\n")) {
+		t.Errorf("manifest does not list both files:\n%s", manifest)
+	}
+
+	// Second run on a clean directory verifies against it, and the content has changed
+	os.Remove(filepath.Join(outputDir, "a.txt"))
+	os.Remove(filepath.Join(outputDir, "b.txt"))
+	content = "tampered"
+	for _, result := range downloader.DownloadURLs(context.Background(), urls) {
+		if result.Success {
+			t.Errorf("expected %s to fail verification", result.URL)
+		}
+		if _, err := os.Stat(result.OutputPath); !os.IsNotExist(err) {
+			t.Errorf("expected mismatching file %s to be deleted", result.OutputPath)
+		}
+	}
+
+	// Files kept by --no-clobber are checked but never deleted
+	os.WriteFile(filepath.Join(outputDir, "a.txt"), []byte("mine"), 0o644)
+	keep := NewConcurrentDownloader(1, outputDir, &models.Options{ChecksumManifest: manifestPath, NoClobber: true})
+	results := keep.DownloadURLs(context.Background(), urls[:1])
+	if len(results) != 1 || results[0].Success {
+		t.Errorf("expected the kept file to fail verification, got %+v", results)
+	}
+	if got, _ := os.ReadFile(filepath.Join(outputDir, "a.txt")); string(got) != "mine" {
+		t.Errorf("expected the kept file to stay, got %q", got)
+	}
+
+	// A broken manifest is a parse error, and leaves nothing verified
+	os.WriteFile(manifestPath, []byte("not-a-manifest-line\n"), 0o644)
+	os.Remove(filepath.Join(outputDir, "a.txt"))
+	results = downloader.DownloadURLs(context.Background(), urls[:1])
+	if len(results) != 1 || results[0].Success || ExitStatus(results[0].Error) != ExitParse {
+		t.Errorf("expected a parse error for the broken manifest, got %+v", results)
+	}
+
+	// No manifest is written from an interrupted or partly failed run
+	partialPath := filepath.Join(t.TempDir(), "SHA256SUMS")
+	partial := NewConcurrentDownloader(1, t.TempDir(), &models.Options{ChecksumManifest: partialPath})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	partial.DownloadURLs(ctx, urls)
+	partial.DownloadURLs(context.Background(), []string{urls[0], "http://127.0.0.1:1/missing.txt"})
+	if _, err := os.Stat(partialPath); !os.IsNotExist(err) {
+		t.Errorf("expected no manifest of an incomplete run, got %v", err)
+	}
+}
+
+// TestPartFile tests that an interrupted download stays in a .part file until it can be resumed
+func TestPartFile(t *testing.T) {
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	truncate := true
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if truncate {
+			// Promise the whole file but hang up halfway through
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			_, _ = w.Write(content[:10])
+			return
+		}
+		http.ServeContent(w, r, "file.txt", time.Time{}, bytes.NewReader(content))
+	}))
+	defer mockServer.Close()
+
+	outputPath := filepath.Join(t.TempDir(), "file.txt")
+
+	if err := downloadFileWithProgress(context.Background(), mockServer.URL, outputPath, nil, false, os.Stdout); err == nil {
+		t.Fatalf("expected truncated download to fail")
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Errorf("expected no file under the final name after a failed download")
+	}
+	if partial, err := os.ReadFile(outputPath + ".part"); err != nil || !bytes.Equal(partial, content[:10]) {
+		t.Fatalf("expected .part file with the received bytes, got %q (%v)", partial, err)
+	}
+
+	truncate = false
+	if err := downloadFileWithProgress(context.Background(), mockServer.URL, outputPath, &models.Options{Continue: true}, false, os.Stdout); err != nil {
+		t.Fatalf("expected resumed download to succeed, got %v", err)
+	}
+	if got, err := os.ReadFile(outputPath); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("expected content %q, got %q (%v)", content, got, err)
+	}
+	if _, err := os.Stat(outputPath + ".part"); !os.IsNotExist(err) {
+		t.Errorf("expected .part file to be renamed away")
+	}
+}
+
+// TestWriteFileAtomic tests the WriteFileAtomic function
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "index.html")
+
+	if err := os.WriteFile(path, []byte("old"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := WriteFileAtomic(path, []byte("new"), 0o644); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if got, _ := os.ReadFile(path); string(got) != "new" {
+		t.Errorf("expected content %q, got %q", "new", got)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("expected temporary files to be cleaned up, found %d entries", len(entries))
+	}
+}
+
+// TestSanitizeFilename tests the SanitizeFilename function
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"/download", "download"},
+		{"../../etc/passwd", "passwd"},
+		{`..\..\evil.txt`, "evil.txt"},
+		{"..", ""},
+		{"", ""},
+		{`a:b*c?.txt`, "a_b_c_.txt"},
+	}
+
+	for _, test := range tests {
+		if got := SanitizeFilename(test.input); got != test.expected {
+			t.Errorf("SanitizeFilename(%q) = %q, want %q", test.input, got, test.expected)
+		}
+	}
+}
+
+// TestServerFilenames tests naming files after Content-Disposition and redirects
+func TestServerFilenames(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="../../report.pdf"`)
+		_, _ = w.Write([]byte("pdf"))
+	})
+	mux.HandleFunc("/latest", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/files/release-1.2.tar.gz", http.StatusFound)
+	})
+	mux.HandleFunc("/files/release-1.2.tar.gz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("tarball"))
+	})
+	mockServer := httptest.NewServer(mux)
+	defer mockServer.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		opts     *models.Options
+		expected string
+	}{
+		{name: "Content-Disposition", path: "/download", opts: &models.Options{ContentDisposition: true}, expected: "report.pdf"},
+		{name: "Content-Disposition disabled", path: "/download", opts: &models.Options{}, expected: "download"},
+		{name: "Trust server names", path: "/latest", opts: &models.Options{TrustServerNames: true}, expected: "release-1.2.tar.gz"},
+		{name: "-O wins", path: "/download", opts: &models.Options{ContentDisposition: true, OutputFile: "mine.pdf"}, expected: "download"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			result := download(context.Background(), mockServer.URL+tt.path, filepath.Join(dir, filepath.Base(tt.path)), tt.opts, false, os.Stdout)
+			if result.Error != nil {
+				t.Fatalf("expected no error, got %v", result.Error)
+			}
+			if want := filepath.Join(dir, tt.expected); result.OutputPath != want {
+				t.Errorf("expected output path %s, got %s", want, result.OutputPath)
+			}
+			if _, err := os.Stat(result.OutputPath); err != nil {
+				t.Errorf("expected file %s to exist: %v", result.OutputPath, err)
+			}
+		})
+	}
+}
+
+// TestCollisionPolicies tests what happens when the output file already exists
+func TestCollisionPolicies(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("new"))
+	}))
+	defer mockServer.Close()
+
+	tests := []struct {
+		name     string
+		opts     *models.Options
+		existing []string          // Files present before the download
+		expected map[string]string // File contents after the download
+	}{
+		{
+			name:     "Numbered suffix",
+			opts:     &models.Options{},
+			existing: []string{"file.txt", "file.txt.1"},
+			expected: map[string]string{"file.txt": "file.txt", "file.txt.1": "file.txt.1", "file.txt.2": "new"},
+		},
+		{
+			name:     "No clobber",
+			opts:     &models.Options{NoClobber: true},
+			existing: []string{"file.txt"},
+			expected: map[string]string{"file.txt": "file.txt"},
+		},
+		{
+			name:     "Backups",
+			opts:     &models.Options{Backups: 2},
+			existing: []string{"file.txt", "file.txt.1", "file.txt.2"},
+			expected: map[string]string{"file.txt": "new", "file.txt.1": "file.txt", "file.txt.2": "file.txt.1"},
+		},
+		{
+			name:     "Explicit output file overwrites",
+			opts:     &models.Options{OutputFile: "file.txt"},
+			existing: []string{"file.txt"},
+			expected: map[string]string{"file.txt": "new"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.existing {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+					t.Fatalf("failed to write file: %v", err)
+				}
+			}
+
+			if err := downloadFileWithProgress(context.Background(), mockServer.URL, filepath.Join(dir, "file.txt"), tt.opts, false, os.Stdout); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != len(tt.expected) {
+				t.Errorf("expected %d files, got %d", len(tt.expected), len(entries))
+			}
+			for name, want := range tt.expected {
+				if got, _ := os.ReadFile(filepath.Join(dir, name)); string(got) != want {
+					t.Errorf("expected %s to contain %q, got %q", name, want, got)
+				}
+			}
+		})
+	}
+}
+
+// TestDownloadURLsSameName tests that URLs sharing a file name don't overwrite each other
+func TestDownloadURLsSameName(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer mockServer.Close()
+
+	outputDir := t.TempDir()
+	urls := []string{mockServer.URL + "/a/logo.png", mockServer.URL + "/b/logo.png", mockServer.URL + "/c/logo.png"}
+	results := NewConcurrentDownloader(3, outputDir, &models.Options{}).DownloadURLs(context.Background(), urls)
+
+	contents := make(map[string]bool)
+	for _, result := range results {
+		if !result.Success {
+			t.Fatalf("expected %s to succeed, got %v", result.URL, result.Error)
+		}
+		data, err := os.ReadFile(result.OutputPath)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", result.OutputPath, err)
+		}
+		contents[string(data)] = true
+	}
+	if len(contents) != len(urls) {
+		t.Errorf("expected %d distinct files, got %d", len(urls), len(contents))
+	}
+}
+
+// TestTimestamping tests that -N skips unchanged files and keeps the server's timestamp
+func TestTimestamping(t *testing.T) {
+	lastModified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	etag := `"v1"`
+	var sentETags []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sentETags = append(sentETags, r.Header.Get("If-None-Match"))
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "file.txt", lastModified, strings.NewReader("content "+etag))
+	}))
+	defer mockServer.Close()
+
+	cacheDir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cacheDir)
+	outputDir := t.TempDir()
+	outputPath := filepath.Join(outputDir, "file.txt")
+	opts := &models.Options{Timestamping: true}
+
+	// First run downloads the file and takes over its timestamp
+	result := download(context.Background(), mockServer.URL, outputPath, opts, false, os.Stdout)
+	if result.Error != nil || result.Skipped {
+		t.Fatalf("expected download, got skipped=%v error=%v", result.Skipped, result.Error)
+	}
+	if info, err := os.Stat(outputPath); err != nil || !info.ModTime().Equal(lastModified) {
+		t.Errorf("expected mtime %v, got %v (%v)", lastModified, info.ModTime(), err)
+	}
+
+	// Second run sends the stored ETag and is told nothing changed
+	result = download(context.Background(), mockServer.URL, outputPath, opts, false, os.Stdout)
+	if result.Error != nil || !result.Skipped {
+		t.Errorf("expected unchanged file to be skipped, got skipped=%v error=%v", result.Skipped, result.Error)
+	}
+	if sentETags[1] != etag {
+		t.Errorf("expected If-None-Match %s, got %q", etag, sentETags[1])
+	}
+	if entries, _ := os.ReadDir(outputDir); len(entries) != 1 {
+		t.Errorf("expected only the download in the output directory, got %v", entries)
+	}
+	if shards, err := os.ReadDir(filepath.Join(cacheDir, "wget", "etags")); err != nil || len(shards) != 1 {
+		t.Errorf("expected the ETag to be kept in the cache directory, got %v (%v)", shards, err)
+	}
+
+	// A new version replaces the file in place
+	etag = `"v2"`
+	lastModified = lastModified.Add(time.Hour)
+	result = download(context.Background(), mockServer.URL, outputPath, opts, false, os.Stdout)
+	if result.Error != nil || result.Skipped || result.OutputPath != outputPath {
+		t.Fatalf("expected updated file at %s, got %s skipped=%v error=%v", outputPath, result.OutputPath, result.Skipped, result.Error)
+	}
+	if got, _ := os.ReadFile(outputPath); string(got) != `content "v2"` {
+		t.Errorf("expected updated content, got %q", got)
+	}
+}
+
+// TestETagStore tests that ETags are kept per output directory and that compaction
+// drops the entries of deleted files
+func TestETagStore(t *testing.T) {
+	cacheDir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cacheDir)
+
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for _, path := range []string{filepath.Join(dirA, "kept.txt"), filepath.Join(dirA, "gone.txt"), filepath.Join(dirB, "kept.txt")} {
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	SaveETag(filepath.Join(dirA, "kept.txt"), `"a1"`)
+	SaveETag(filepath.Join(dirA, "kept.txt"), `"a2"`)
+	SaveETag(filepath.Join(dirA, "gone.txt"), `"g"`)
+	SaveETag(filepath.Join(dirB, "kept.txt"), `"b"`)
+
+	if got := LoadETag(filepath.Join(dirA, "kept.txt")); got != `"a2"` {
+		t.Errorf("expected the latest ETag \"a2\", got %q", got)
+	}
+	if got := LoadETag(filepath.Join(dirB, "kept.txt")); got != `"b"` {
+		t.Errorf("expected the other directory's ETag \"b\", got %q", got)
+	}
+	if shards, _ := os.ReadDir(filepath.Join(cacheDir, "wget", "etags")); len(shards) != 2 {
+		t.Errorf("expected one ETag file per directory, got %v", shards)
+	}
+
+	// Later lines win when the file is read back
+	filename, err := etagFile(dirA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etags := readETags(filename)
+	if len(etags) != 2 || etags["kept.txt"] != `"a2"` {
+		t.Errorf("expected appended entries to replace earlier ones, got %v", etags)
+	}
+
+	os.Remove(filepath.Join(dirA, "gone.txt"))
+	etagMu.Lock()
+	err = compactETags(filename, dirA)
+	etagMu.Unlock()
+	if err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	if got, _ := os.ReadFile(filename); string(got) != "\"a2\"\tkept.txt\n" {
+		t.Errorf("expected only the existing file after compaction, got %q", got)
+	}
+	if got := LoadETag(filepath.Join(dirA, "gone.txt")); got != "" {
+		t.Errorf("expected the deleted file's ETag to be dropped, got %q", got)
+	}
+}
+
+// TestTimestampingServerNames tests that -N doesn't compare against the URL's file name
+// when the server picks the name
+func TestTimestampingServerNames(t *testing.T) {
+	var conditional bool
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditional = r.Header.Get("If-Modified-Since") != ""
+		w.Header().Set("Content-Disposition", `attachment; filename="report.txt"`)
+		http.ServeContent(w, r, "report.txt", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), strings.NewReader("report"))
+	}))
+	defer mockServer.Close()
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	// An unrelated, newer file under the name from the URL
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "download"), []byte("mine"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &models.Options{Timestamping: true, ContentDisposition: true}
+	result := download(context.Background(), mockServer.URL+"/download", filepath.Join(dir, "download"), opts, false, os.Stdout)
+	if result.Error != nil || result.Skipped {
+		t.Fatalf("expected download, got skipped=%v error=%v", result.Skipped, result.Error)
+	}
+	if conditional {
+		t.Errorf("expected no conditional request before the server named the file")
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "report.txt")); string(got) != "report" {
+		t.Errorf("expected report.txt to be downloaded, got %q", got)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "download")); string(got) != "mine" {
+		t.Errorf("expected the unrelated file to be kept, got %q", got)
+	}
+}
+
+// TestCustomRequests tests that headers, method and body are sent with downloads
+func TestCustomRequests(t *testing.T) {
+	bodyFile := filepath.Join(t.TempDir(), "query.json")
+	if err := os.WriteFile(bodyFile, []byte(`{"q":1}`), 0o644); err != nil {
+		t.Fatalf("failed to write body file: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		opts           *models.Options
+		expectedMethod string
+		expectedBody   string
+		expectedType   string
+		expectedAgent  string
+	}{
+		{
+			name:           "Defaults",
+			opts:           &models.Options{},
+			expectedMethod: "GET",
+			expectedAgent:  DefaultUserAgent,
+		},
+		{
+			name:           "Headers and user agent",
+			opts:           &models.Options{Headers: []string{"Authorization: Bearer token"}, UserAgent: "ci-bot/1.0"},
+			expectedMethod: "GET",
+			expectedAgent:  "ci-bot/1.0",
+		},
+		{
+			name:           "Post data",
+			opts:           &models.Options{PostData: "a=1&b=2"},
+			expectedMethod: "POST",
+			expectedBody:   "a=1&b=2",
+			expectedType:   "application/x-www-form-urlencoded",
+			expectedAgent:  DefaultUserAgent,
+		},
+		{
+			name:           "Body file with method",
+			opts:           &models.Options{BodyFile: bodyFile, Method: "put", Headers: []string{"Content-Type: application/json"}},
+			expectedMethod: "PUT",
+			expectedBody:   `{"q":1}`,
+			expectedType:   "application/json",
+			expectedAgent:  DefaultUserAgent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			var gotBody []byte
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r
+				gotBody, _ = io.ReadAll(r.Body)
+				_, _ = w.Write([]byte("ok"))
+			}))
+			defer mockServer.Close()
+
+			if err := downloadFileWithProgress(context.Background(), mockServer.URL, filepath.Join(t.TempDir(), "out"), tt.opts, false, os.Stdout); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if got.Method != tt.expectedMethod {
+				t.Errorf("expected method %s, got %s", tt.expectedMethod, got.Method)
+			}
+			if string(gotBody) != tt.expectedBody {
+				t.Errorf("expected body %q, got %q", tt.expectedBody, gotBody)
+			}
+			if got.Header.Get("Content-Type") != tt.expectedType {
+				t.Errorf("expected Content-Type %q, got %q", tt.expectedType, got.Header.Get("Content-Type"))
+			}
+			if got.UserAgent() != tt.expectedAgent {
+				t.Errorf("expected User-Agent %q, got %q", tt.expectedAgent, got.UserAgent())
+			}
+			for _, header := range tt.opts.Headers {
+				name, value, _ := strings.Cut(header, ":")
+				if got.Header.Get(name) != strings.TrimSpace(value) {
+					t.Errorf("expected header %s: %s, got %q", name, value, got.Header.Get(name))
+				}
+			}
+		})
+	}
+}
+
+// TestCookies tests loading cookies.txt, sending the cookies and saving the ones the server sets
+func TestCookies(t *testing.T) {
+	var gotSession string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err == nil {
+			gotSession = c.Value
+		}
+		http.SetCookie(w, &http.Cookie{Name: "visit", Value: "1", Path: "/", MaxAge: 3600})
+		http.SetCookie(w, &http.Cookie{Name: "temp", Value: "x", Path: "/"})
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer mockServer.Close()
+
+	dir := t.TempDir()
+	loadPath := filepath.Join(dir, "cookies.txt")
+	expires := time.Now().Add(time.Hour).Unix()
+	cookiesTxt := fmt.Sprintf("# Netscape HTTP Cookie File\n127.0.0.1\tFALSE\t/\tFALSE\t%d\tsession\tabc123\n", expires)
+	if err := os.WriteFile(loadPath, []byte(cookiesTxt), 0o644); err != nil {
+		t.Fatalf("failed to write cookies file: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		keepSession bool
+		expected    []string
+		notExpected []string
+	}{
+		{name: "Persistent cookies only", keepSession: false, expected: []string{"session\tabc123", "visit\t1"}, notExpected: []string{"temp"}},
+		{name: "Keep session cookies", keepSession: true, expected: []string{"session\tabc123", "visit\t1", "temp\tx"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotSession = ""
+			savePath := filepath.Join(t.TempDir(), "saved.txt")
+			opts := &models.Options{LoadCookies: loadPath, SaveCookies: savePath, KeepSessionCookies: tt.keepSession}
+			if err := downloadFileWithProgress(context.Background(), mockServer.URL, filepath.Join(t.TempDir(), "out"), opts, false, os.Stdout); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if gotSession != "abc123" {
+				t.Errorf("expected loaded cookie to be sent, got %q", gotSession)
+			}
+
+			saved, err := os.ReadFile(savePath)
+			if err != nil {
+				t.Fatalf("expected cookies to be saved: %v", err)
+			}
+			for _, want := range tt.expected {
+				if !strings.Contains(string(saved), want) {
+					t.Errorf("expected saved cookies to contain %q:\n%s", want, saved)
+				}
+			}
+			for _, unwanted := range tt.notExpected {
+				if strings.Contains(string(saved), unwanted) {
+					t.Errorf("expected saved cookies not to contain %q:\n%s", unwanted, saved)
+				}
+			}
+		})
+	}
+}
+
+func TestCookieJarRejectedDomains(t *testing.T) {
+	jar, err := NewCookieJar()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	evil, _ := url.Parse("http://www.evil.example/")
+	jar.SetCookies(evil, []*http.Cookie{
+		{Name: "sess", Value: "attacker", Domain: "bank.com", MaxAge: 3600},
+		{Name: "wide", Value: "attacker", Domain: "example", MaxAge: 3600},
+		{Name: "own", Value: "ok", Domain: "evil.example", MaxAge: 3600},
+	})
+
+	savePath := filepath.Join(t.TempDir(), "cookies.txt")
+	if err := jar.Save(savePath, false); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	saved, _ := os.ReadFile(savePath)
+	if strings.Contains(string(saved), "attacker") || !strings.Contains(string(saved), ".evil.example\tTRUE") {
+		t.Errorf("expected only the cookie for evil.example to be saved:\n%s", saved)
+	}
+
+	loaded, _ := NewCookieJar()
+	if err := loaded.Load(savePath); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	bank, _ := url.Parse("http://bank.com/")
+	if cookies := loaded.Cookies(bank); len(cookies) != 0 {
+		t.Errorf("expected no cookies for bank.com, got %v", cookies)
+	}
+}
+
+// digestServer answers with 401 until the request carries a valid Digest response
+func digestServer(algorithm, user, password string) *httptest.Server {
+	const realm, nonce = "test", "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+	h := func(s string) string {
+		if algorithm == "SHA-256" {
+			return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+		}
+		return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, ok := parseChallenge(r.Header.Get("Authorization")); ok && c.scheme == "digest" {
+			p := c.params
+			ha1 := h(user + ":" + realm + ":" + password)
+			ha2 := h(r.Method + ":" + p["uri"])
+			expected := h(ha1 + ":" + nonce + ":" + p["nc"] + ":" + p["cnonce"] + ":" + p["qop"] + ":" + ha2)
+			if p["username"] == user && p["response"] == expected && p["opaque"] == "xyz" {
+				_, _ = w.Write([]byte("secret"))
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest realm=%q, qop="auth,auth-int", algorithm=%s, nonce=%q, opaque="xyz"`, realm, algorithm, nonce))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+}
+
+func TestAuthentication(t *testing.T) {
+	basicServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); ok && user == "alice" && password == "s3cret" {
+			_, _ = w.Write([]byte("secret"))
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer basicServer.Close()
+
+	bearerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("secret"))
+	}))
+	defer bearerServer.Close()
+
+	md5Server := digestServer("MD5", "alice", "s3cret")
+	defer md5Server.Close()
+	sha256Server := digestServer("SHA-256", "alice", "s3cret")
+	defer sha256Server.Close()
+
+	// Redirects to another host must not carry the credentials along
+	var leaked string
+	otherHost := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte("public"))
+	}))
+	defer otherHost.Close()
+	redirectServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, strings.Replace(otherHost.URL, "127.0.0.1", "localhost", 1), http.StatusFound)
+	}))
+	defer redirectServer.Close()
+
+	netrcPath := filepath.Join(t.TempDir(), "netrc")
+	netrc := "machine 127.0.0.1 login alice password s3cret\n"
+	if err := os.WriteFile(netrcPath, []byte(netrc), 0o600); err != nil {
+		t.Fatalf("failed to write netrc: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		url         string
+		opts        *models.Options
+		netrc       string
+		expectError bool
+	}{
+		{name: "Basic", url: basicServer.URL, opts: &models.Options{User: "alice", Password: "s3cret"}},
+		{name: "Basic wrong password", url: basicServer.URL, opts: &models.Options{User: "alice", Password: "nope"}, expectError: true},
+		{name: "No credentials", url: basicServer.URL, opts: &models.Options{}, expectError: true},
+		{name: "Digest MD5", url: md5Server.URL, opts: &models.Options{User: "alice", Password: "s3cret"}},
+		{name: "Digest SHA-256", url: sha256Server.URL, opts: &models.Options{User: "alice", Password: "s3cret"}},
+		{name: "Digest wrong password", url: sha256Server.URL, opts: &models.Options{User: "alice", Password: "nope"}, expectError: true},
+		{name: "Bearer", url: bearerServer.URL, opts: &models.Options{BearerToken: "tok"}},
+		{name: "Netrc", url: md5Server.URL, opts: &models.Options{}, netrc: netrcPath},
+		{name: "Netrc disabled", url: md5Server.URL, opts: &models.Options{NoNetrc: true}, netrc: netrcPath, expectError: true},
+		{name: "Redirect to other host", url: redirectServer.URL, opts: &models.Options{BearerToken: "tok"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("NETRC", tt.netrc)
+			if tt.netrc == "" {
+				t.Setenv("NETRC", filepath.Join(t.TempDir(), "missing"))
+			}
+			leaked = ""
+
+			err := downloadFileWithProgress(context.Background(), tt.url, filepath.Join(t.TempDir(), "out"), tt.opts, false, os.Stdout)
+			if tt.expectError && err == nil {
+				t.Errorf("expected an error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+			if leaked != "" {
+				t.Errorf("expected no credentials after redirecting to another host, got %q", leaked)
+			}
+		})
+	}
+}
+
+// TestAuthTransportLeavesRequest tests that answering a Basic challenge doesn't touch the caller's request
+func TestAuthTransportLeavesRequest(t *testing.T) {
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get("Authorization"))
+		if _, _, ok := r.BasicAuth(); !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "missing"))
+
+	transport := newAuthTransport(http.DefaultTransport, &models.Options{User: "alice", Password: "s3cret"})
+	transport.authorizeHost(server.URL)
+
+	// The second request answers up front, as the host challenged the first
+	for range 2 {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The caller may read its request while it is in flight (caught with -race)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_ = req.Header.Get("Authorization")
+		}()
+		resp, err := transport.RoundTrip(req)
+		<-done
+		if err != nil {
+			t.Fatalf("round trip failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected 200, got %s", resp.Status)
+		}
+		if len(req.Header) != 0 {
+			t.Errorf("expected the caller's headers to be left alone, got %v", req.Header)
+		}
+	}
+
+	expected := []string{"", "Basic YWxpY2U6czNjcmV0", "Basic YWxpY2U6czNjcmV0"}
+	if strings.Join(received, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected Authorization headers %q, got %q", expected, received)
+	}
+}
+
+func TestParseNetrc(t *testing.T) {
+	data := `machine example.com login alice password one
+macdef init
+	cd /pub
+	bin
+
+machine other.org
+	login bob
+	password two
+default login anonymous password guest
+`
+	entries := parseNetrc(data)
+
+	tests := []struct {
+		host     string
+		login    string
+		password string
+	}{
+		{host: "example.com", login: "alice", password: "one"},
+		{host: "OTHER.org", login: "bob", password: "two"},
+		{host: "unknown.net", login: "anonymous", password: "guest"},
+	}
+
+	for _, tt := range tests {
+		entry, ok := lookupNetrc(entries, tt.host)
+		if !ok || entry.login != tt.login || entry.password != tt.password {
+			t.Errorf("lookupNetrc(%q) = %+v, %v; expected %s/%s", tt.host, entry, ok, tt.login, tt.password)
+		}
+	}
+}
+
+// socks5Server is a minimal SOCKS5 proxy (no authentication, CONNECT only) counting its connections
+func socks5Server(t *testing.T, connections *atomic.Int64) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connections.Add(1)
+
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 262)
+				// Greeting: version, number of methods, methods
+				if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0})
+
+				// Request: version, command, reserved, address type, address, port
+				if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+					return
+				}
+				var host string
+				switch buf[3] {
+				case 1:
+					io.ReadFull(conn, buf[:4])
+					host = net.IP(buf[:4]).String()
+				case 3:
+					io.ReadFull(conn, buf[:1])
+					n := int(buf[0])
+					io.ReadFull(conn, buf[:n])
+					host = string(buf[:n])
+				default:
+					return
+				}
+				io.ReadFull(conn, buf[:2])
+				port := int(buf[0])<<8 | int(buf[1])
+
+				target, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+				if err != nil {
+					conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestProxy(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("direct"))
+	}))
+	defer target.Close()
+
+	// An HTTP proxy answering every request itself
+	var proxied int
+	var proxyAuth string
+	httpProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied++
+		proxyAuth = r.Header.Get("Proxy-Authorization")
+		_, _ = w.Write([]byte("via proxy " + r.URL.Host))
+	}))
+	defer httpProxy.Close()
+
+	var socksConnections atomic.Int64
+	socks := socks5Server(t, &socksConnections)
+	defer socks.Close()
+
+	tests := []struct {
+		name          string
+		url           string
+		opts          *models.Options
+		env           map[string]string
+		expected      string
+		expectProxied bool
+		expectAuth    string
+		expectSocks   bool
+	}{
+		{name: "Explicit HTTP proxy", url: "http://files.wget.test/a", opts: &models.Options{Proxy: httpProxy.URL}, expected: "via proxy files.wget.test", expectProxied: true},
+		{name: "Proxy authentication", url: "http://files.wget.test/a", opts: &models.Options{Proxy: httpProxy.URL, ProxyUser: "bob", ProxyPassword: "pw"}, expected: "via proxy files.wget.test", expectProxied: true, expectAuth: "Basic Ym9iOnB3"},
+		{name: "Proxy from environment", url: "http://files.wget.test/a", opts: &models.Options{}, env: map[string]string{"http_proxy": httpProxy.URL}, expected: "via proxy files.wget.test", expectProxied: true},
+		{name: "Environment proxy skips localhost", url: target.URL, opts: &models.Options{}, env: map[string]string{"http_proxy": httpProxy.URL}, expected: "direct"},
+		{name: "no_proxy", url: target.URL, opts: &models.Options{Proxy: httpProxy.URL}, env: map[string]string{"no_proxy": "127.0.0.1"}, expected: "direct"},
+		{name: "No proxy flag", url: "http://" + target.Listener.Addr().String() + "/", opts: &models.Options{NoProxy: true}, env: map[string]string{"http_proxy": "http://127.0.0.1:1"}, expected: "direct"},
+		{name: "SOCKS5", url: target.URL, opts: &models.Options{Proxy: "socks5://" + socks.Addr().String()}, expected: "direct", expectSocks: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"http_proxy", "HTTP_PROXY", "https_proxy", "HTTPS_PROXY", "all_proxy", "ALL_PROXY", "no_proxy", "NO_PROXY"} {
+				t.Setenv(name, tt.env[name])
+			}
+			proxied, proxyAuth = 0, ""
+			socksConnections.Store(0)
+
+			outputPath := filepath.Join(t.TempDir(), "out")
+			if err := downloadFileWithProgress(context.Background(), tt.url, outputPath, tt.opts, false, os.Stdout); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			content, _ := os.ReadFile(outputPath)
+			if string(content) != tt.expected {
+				t.Errorf("expected content %q, got %q", tt.expected, content)
+			}
+			if (proxied > 0) != tt.expectProxied {
+				t.Errorf("expected proxied=%v, got %d proxied requests", tt.expectProxied, proxied)
+			}
+			if proxyAuth != tt.expectAuth {
+				t.Errorf("expected Proxy-Authorization %q, got %q", tt.expectAuth, proxyAuth)
+			}
+			if (socksConnections.Load() > 0) != tt.expectSocks {
+				t.Errorf("expected SOCKS5=%v, got %d connections", tt.expectSocks, socksConnections.Load())
+			}
+		})
+	}
+}
+
+func TestNoProxyMatch(t *testing.T) {
+	tests := []struct {
+		host     string
+		port     string
+		noProxy  string
+		expected bool
+	}{
+		{host: "example.com", noProxy: "example.com", expected: true},
+		{host: "www.example.com", noProxy: "example.com", expected: true},
+		{host: "www.example.com", noProxy: ".example.com", expected: true},
+		{host: "example.com", noProxy: ".example.com", expected: true},
+		{host: "badexample.com", noProxy: "example.com", expected: false},
+		{host: "anything.org", noProxy: "*", expected: true},
+		{host: "10.1.2.3", noProxy: "10.0.0.0/8", expected: true},
+		{host: "11.1.2.3", noProxy: "10.0.0.0/8", expected: false},
+		{host: "example.com", port: "8080", noProxy: "example.com:8080", expected: true},
+		{host: "example.com", port: "443", noProxy: "example.com:8080", expected: false},
+		{host: "example.com", noProxy: "", expected: false},
+	}
+
+	for _, tt := range tests {
+		if got := noProxyMatch(tt.host, tt.port, tt.noProxy); got != tt.expected {
+			t.Errorf("noProxyMatch(%q, %q, %q) = %v; expected %v", tt.host, tt.port, tt.noProxy, got, tt.expected)
+		}
+	}
+}
+
+// writeClientCertificate writes a self-signed client certificate and its key as PEM files
+func writeClientCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestTLS(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secure"))
+	})
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	// Only accepts TLS 1.2, to test --secure-protocol
+	tls12Server := httptest.NewUnstartedServer(handler)
+	tls12Server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	tls12Server.StartTLS()
+	defer tls12Server.Close()
+
+	// Requires a client certificate, to test mutual TLS
+	mtlsServer := httptest.NewUnstartedServer(handler)
+	mtlsServer.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	mtlsServer.StartTLS()
+	defer mtlsServer.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o644); err != nil {
+		t.Fatalf("failed to write CA file: %v", err)
+	}
+	caDir := filepath.Join(dir, "certs")
+	os.Mkdir(caDir, 0o755)
+	os.WriteFile(filepath.Join(caDir, "test.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o644)
+	os.WriteFile(filepath.Join(caDir, "README"), []byte("not a certificate"), 0o644)
+	certFile, keyFile := writeClientCertificate(t, dir)
+
+	spki := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	pin := "sha256//" + base64.StdEncoding.EncodeToString(spki[:])
+	wrongPin := "sha256//" + base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	tests := []struct {
+		name        string
+		url         string
+		opts        *models.Options
+		expectError bool
+	}{
+		{name: "Untrusted certificate", url: server.URL, opts: &models.Options{}, expectError: true},
+		{name: "CA certificate", url: server.URL, opts: &models.Options{CACertificate: caFile}},
+		{name: "CA directory", url: server.URL, opts: &models.Options{CADirectory: caDir}},
+		{name: "No check certificate", url: server.URL, opts: &models.Options{NoCheckCertificate: true}},
+		{name: "Pinned public key", url: server.URL, opts: &models.Options{CACertificate: caFile, PinnedPubKey: pin}},
+		{name: "Invalid pinned public key", url: server.URL, opts: &models.Options{NoCheckCertificate: true, PinnedPubKey: "sha256//x;" + wrongPin}, expectError: true},
+		{name: "Pin mismatch without verification", url: server.URL, opts: &models.Options{NoCheckCertificate: true, PinnedPubKey: wrongPin}, expectError: true},
+		{name: "TLS 1.2 accepted", url: tls12Server.URL, opts: &models.Options{NoCheckCertificate: true, MinTLSVersion: "TLSv1_2"}},
+		{name: "TLS 1.3 required", url: tls12Server.URL, opts: &models.Options{NoCheckCertificate: true, MinTLSVersion: "1.3"}, expectError: true},
+		{name: "Missing client certificate", url: mtlsServer.URL, opts: &models.Options{NoCheckCertificate: true}, expectError: true},
+		{name: "Client certificate", url: mtlsServer.URL, opts: &models.Options{NoCheckCertificate: true, Certificate: certFile, PrivateKey: keyFile}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := downloadFileWithProgress(context.Background(), tt.url, filepath.Join(t.TempDir(), "out"), tt.opts, false, os.Stdout)
+			if tt.expectError && err == nil {
+				t.Errorf("expected an error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	// Waits before sending the headers
+	slowHeaders := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(300 * time.Millisecond):
+		}
+		_, _ = w.Write([]byte("late"))
+	}))
+	defer slowHeaders.Close()
+
+	// Sends half of the body, then goes quiet on every request but the last one
+	var mu sync.Mutex
+	requests := 0
+	stalling := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+			w.Header().Set("Content-Range", "bytes 5-9/10")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write([]byte("56789"))
+			return
+		}
+		w.Header().Set("Content-Length", "10")
+		_, _ = w.Write([]byte("01234"))
+		w.(http.Flusher).Flush()
+		if n < 2 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+			return
+		}
+		_, _ = w.Write([]byte("56789"))
+	}))
+	defer stalling.Close()
+
+	tests := []struct {
+		name          string
+		url           string
+		opts          *models.Options
+		expectError   string
+		expectContent string
+	}{
+		{name: "Read timeout waiting for headers", url: slowHeaders.URL, opts: &models.Options{ReadTimeout: 100 * time.Millisecond}, expectError: "timeout"},
+		{name: "Timeout sets the read timeout", url: slowHeaders.URL, opts: &models.Options{Timeout: 100 * time.Millisecond}, expectError: "timeout"},
+		{name: "Read timeout long enough", url: slowHeaders.URL, opts: &models.Options{ReadTimeout: time.Second}, expectContent: "late"},
+		{name: "Stall", url: stalling.URL, opts: &models.Options{StallTimeout: 100 * time.Millisecond}, expectError: "stalled"},
+		{name: "Stall then retry", url: stalling.URL, opts: &models.Options{StallTimeout: 100 * time.Millisecond, Tries: 2, WaitRetry: time.Millisecond}, expectContent: "0123456789"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			requests = 0
+			mu.Unlock()
+
+			outputPath := filepath.Join(t.TempDir(), "out")
+			err := downloadFileWithProgress(context.Background(), tt.url, outputPath, tt.opts, false, os.Stdout)
+			if tt.expectError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectError) {
+					t.Errorf("expected error containing %q, got %v", tt.expectError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			content, _ := os.ReadFile(outputPath)
+			if string(content) != tt.expectContent {
+				t.Errorf("expected content %q, got %q", tt.expectContent, content)
+			}
+		})
+	}
+}
+
+// captureStdout runs fn with os.Stdout redirected and returns what it wrote there
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	captured := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		captured <- string(data)
+	}()
+
+	fn()
+	w.Close()
+	return <-captured
+}
+
+func TestStdoutAndConcatenation(t *testing.T) {
+	// Drops the connection halfway through the first response, to test resuming a stream
+	var mu sync.Mutex
+	dropped := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("first\n"))
+	})
+	mux.HandleFunc("/b", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("second\n"))
+	})
+	mux.HandleFunc("/flaky", func(w http.ResponseWriter, r *http.Request) {
+		content := "0123456789"
+		if rangeHeader := r.Header.Get("Range"); rangeHeader == "bytes=5-" {
+			w.Header().Set("Content-Range", "bytes 5-9/10")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write([]byte(content[5:]))
+			return
+		}
+		mu.Lock()
+		drop := !dropped
+		dropped = true
+		mu.Unlock()
+
+		w.Header().Set("Content-Length", "10")
+		if drop {
+			_, _ = w.Write([]byte(content[:5]))
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		_, _ = w.Write([]byte(content))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	sum := sha256.Sum256([]byte("first\n"))
+	checksum := fmt.Sprintf("sha256:%x", sum)
+
+	tests := []struct {
+		name        string
+		urls        []string
+		opts        *models.Options
+		expected    string
+		expectError bool
+	}{
+		{name: "Single URL", urls: []string{server.URL + "/a"}, opts: &models.Options{}, expected: "first\n"},
+		{name: "Several URLs", urls: []string{server.URL + "/a", server.URL + "/b"}, opts: &models.Options{}, expected: "first\nsecond\n"},
+		{name: "Checksum", urls: []string{server.URL + "/a"}, opts: &models.Options{Checksum: checksum}, expected: "first\n"},
+		{name: "Checksum mismatch", urls: []string{server.URL + "/b"}, opts: &models.Options{Checksum: checksum}, expected: "second\n", expectError: true},
+		{name: "Resume after dropped connection", urls: []string{server.URL + "/flaky"}, opts: &models.Options{Tries: 2, WaitRetry: time.Millisecond}, expected: "0123456789"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+" to stdout", func(t *testing.T) {
+			dropped = false
+			var err error
+			stdout := captureStdout(t, func() {
+				err = DownloadConcatenated(context.Background(), tt.urls, StdoutPath, tt.opts)
+			})
+			if (err != nil) != tt.expectError {
+				t.Errorf("expected error=%v, got %v", tt.expectError, err)
+			}
+			if stdout != tt.expected {
+				t.Errorf("expected stdout %q, got %q", tt.expected, stdout)
+			}
+		})
+
+		t.Run(tt.name+" to file", func(t *testing.T) {
+			dropped = false
+			outputPath := filepath.Join(t.TempDir(), "all.txt")
+			err := DownloadConcatenated(context.Background(), tt.urls, outputPath, tt.opts)
+			if (err != nil) != tt.expectError {
+				t.Errorf("expected error=%v, got %v", tt.expectError, err)
+			}
+			if tt.expectError {
+				if _, err := os.Stat(outputPath); err == nil {
+					t.Errorf("expected no output file after a failure")
+				}
+				return
+			}
+			content, _ := os.ReadFile(outputPath)
+			if string(content) != tt.expected {
+				t.Errorf("expected content %q, got %q", tt.expected, content)
+			}
+		})
+	}
+
+	// DownloadFile also understands "-"
+	stdout := captureStdout(t, func() {
+		if err := DownloadFile(context.Background(), server.URL+"/b", StdoutPath, &models.Options{}); err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	})
+	if stdout != "second\n" {
+		t.Errorf("expected stdout %q, got %q", "second\n", stdout)
+	}
+}
+
+// fakeFTP is an in-process FTP server serving files from memory
+type fakeFTP struct {
+	listener  net.Listener
+	files     map[string]string // Contents by path, directories are implied
+	user      string            // Required user name, anonymous logins are accepted when empty
+	password  string
+	noEPSV    bool        // Only support PASV
+	tlsConfig *tls.Config // Enables AUTH TLS
+
+	mu       sync.Mutex
+	commands []string
+	drop     map[string]bool // Files whose next RETR drops the connection halfway
+}
+
+// newFakeFTP starts a fake FTP server, stopped when the test ends
+func newFakeFTP(t *testing.T, files map[string]string) *fakeFTP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	f := &fakeFTP{listener: listener, files: files, drop: make(map[string]bool)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// url returns the URL of a path on the server
+func (f *fakeFTP) url(scheme, p string) string {
+	return fmt.Sprintf("%s://%s/%s", scheme, f.listener.Addr(), p)
+}
+
+// sawCommand reports whether the server received a command starting with prefix
+func (f *fakeFTP) sawCommand(prefix string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, cmd := range f.commands {
+		if strings.HasPrefix(cmd, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the LIST lines of a directory
+func (f *fakeFTP) list(dir string) []string {
+	dir = strings.Trim(dir, "/")
+	if dir != "" {
+		dir += "/"
+	}
+	seen := make(map[string]bool)
+	var lines []string
+	for p, content := range f.files {
+		rest, ok := strings.CutPrefix(p, dir)
+		if !ok {
+			continue
+		}
+		name, _, isDir := strings.Cut(rest, "/")
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if isDir {
+			lines = append(lines, "drwxr-xr-x 2 ftp ftp 4096 Jan 01 00:00 "+name)
+		} else {
+			lines = append(lines, fmt.Sprintf("-rw-r--r-- 1 ftp ftp %d Jan 01 00:00 %s", len(content), name))
+		}
+	}
+	return lines
+}
+
+// serve handles one control connection
+func (f *fakeFTP) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(format string, args ...any) { fmt.Fprintf(conn, format+"\r\n", args...) }
+
+	var user string
+	var rest int64
+	var passive net.Listener
+	var activeAddr string
+	protect := false
+
+	// data opens the data connection set up by EPSV/PASV or PORT/EPRT
+	data := func() (net.Conn, error) {
+		var c net.Conn
+		var err error
+		if passive != nil {
+			c, err = passive.Accept()
+			passive.Close()
+			passive = nil
+		} else {
+			c, err = net.Dial("tcp", activeAddr)
+		}
+		if err == nil && protect {
+			c = tls.Server(c, f.tlsConfig)
+		}
+		return c, err
+	}
+
+	reply("220 fake FTP server ready")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		f.mu.Lock()
+		f.commands = append(f.commands, line)
+		f.mu.Unlock()
+		cmd, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(cmd) {
+		case "AUTH":
+			if f.tlsConfig == nil {
+				reply("502 no TLS")
+				continue
+			}
+			reply("234 AUTH TLS ok")
+			tlsConn := tls.Server(conn, f.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			reader = bufio.NewReader(conn)
+		case "PBSZ":
+			reply("200 PBSZ=0")
+		case "PROT":
+			protect = arg == "P"
+			reply("200 protection set")
+		case "USER":
+			user = arg
+			reply("331 password please")
+		case "PASS":
+			if f.user != "" && (user != f.user || arg != f.password) {
+				reply("530 Login incorrect")
+				continue
+			}
+			reply("230 logged in")
+		case "TYPE":
+			reply("200 binary")
+		case "SIZE":
+			content, ok := f.files[arg]
+			if !ok {
+				reply("550 no such file")
+				continue
+			}
+			reply("213 %d", len(content))
+		case "EPSV", "PASV":
+			if cmd == "EPSV" && f.noEPSV {
+				reply("502 EPSV not supported")
+				continue
+			}
+			passive, _ = net.Listen("tcp", "127.0.0.1:0")
+			port := passive.Addr().(*net.TCPAddr).Port
+			if cmd == "EPSV" {
+				reply("229 Entering Extended Passive Mode (|||%d|)", port)
+			} else {
+				reply("227 Entering Passive Mode (10,0,0,1,%d,%d)", port>>8, port&0xff)
+			}
+		case "PORT":
+			var h [4]int
+			var p1, p2 int
+			fmt.Sscanf(arg, "%d,%d,%d,%d,%d,%d", &h[0], &h[1], &h[2], &h[3], &p1, &p2)
+			activeAddr = fmt.Sprintf("%d.%d.%d.%d:%d", h[0], h[1], h[2], h[3], p1<<8|p2)
+			reply("200 PORT ok")
+		case "REST":
+			rest, _ = strconv.ParseInt(arg, 10, 64)
+			reply("350 restarting at %d", rest)
+		case "RETR":
+			content, ok := f.files[arg]
+			if !ok {
+				reply("550 no such file")
+				continue
+			}
+			reply("150 opening data connection")
+			c, err := data()
+			if err != nil {
+				reply("425 can't open data connection")
+				continue
+			}
+			f.mu.Lock()
+			drop := f.drop[arg]
+			f.drop[arg] = false
+			f.mu.Unlock()
+			body := content[rest:]
+			if drop {
+				c.Write([]byte(body[:len(body)/2]))
+				c.Close()
+				reply("426 connection closed; transfer aborted")
+				rest = 0
+				continue
+			}
+			c.Write([]byte(body))
+			c.Close()
+			rest = 0
+			reply("226 transfer complete")
+		case "LIST":
+			reply("150 here comes the listing")
+			c, err := data()
+			if err != nil {
+				reply("425 can't open data connection")
+				continue
+			}
+			for _, entry := range f.list(arg) {
+				fmt.Fprintf(c, "%s\r\n", entry)
+			}
+			c.Close()
+			reply("226 listing sent")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 command not implemented")
+		}
+	}
+}
+
+// testTLSConfig returns a server TLS configuration with a self-signed certificate
+func testTLSConfig() *tls.Config {
+	server := httptest.NewUnstartedServer(nil)
+	server.StartTLS()
+	defer server.Close()
+	return &tls.Config{Certificates: server.TLS.Certificates}
+}
+
+func TestFTP(t *testing.T) {
+	files := map[string]string{"pub/file.txt": "hello over ftp", "private/secret.txt": "top secret"}
+
+	plain := newFakeFTP(t, files)
+	pasvOnly := newFakeFTP(t, files)
+	pasvOnly.noEPSV = true
+	withLogin := newFakeFTP(t, files)
+	withLogin.user, withLogin.password = "alice", "s3cret"
+	secure := newFakeFTP(t, files)
+	secure.tlsConfig = testTLSConfig()
+
+	tests := []struct {
+		name        string
+		url         string
+		opts        *models.Options
+		expected    string
+		expectError bool
+	}{
+		{name: "Passive", url: plain.url("ftp", "pub/file.txt"), opts: &models.Options{}, expected: "hello over ftp"},
+		{name: "PASV fallback", url: pasvOnly.url("ftp", "pub/file.txt"), opts: &models.Options{}, expected: "hello over ftp"},
+		{name: "Active", url: plain.url("ftp", "pub/file.txt"), opts: &models.Options{NoPassiveFTP: true}, expected: "hello over ftp"},
+		{name: "Missing file", url: plain.url("ftp", "pub/missing.txt"), opts: &models.Options{}, expectError: true},
+		{name: "Login in URL", url: strings.Replace(withLogin.url("ftp", "private/secret.txt"), "ftp://", "ftp://alice:s3cret@", 1), opts: &models.Options{}, expected: "top secret"},
+		{name: "Login with --user", url: withLogin.url("ftp", "private/secret.txt"), opts: &models.Options{User: "alice", Password: "s3cret"}, expected: "top secret"},
+		{name: "Wrong password", url: withLogin.url("ftp", "private/secret.txt"), opts: &models.Options{User: "alice", Password: "nope"}, expectError: true},
+		{name: "Anonymous login refused", url: withLogin.url("ftp", "private/secret.txt"), opts: &models.Options{}, expectError: true},
+		{name: "FTPS", url: secure.url("ftps", "pub/file.txt"), opts: &models.Options{NoCheckCertificate: true}, expected: "hello over ftp"},
+		{name: "FTPS untrusted certificate", url: secure.url("ftps", "pub/file.txt"), opts: &models.Options{}, expectError: true},
+	}
+
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "missing"))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputPath := filepath.Join(t.TempDir(), "out")
+			err := downloadFileWithProgress(context.Background(), tt.url, outputPath, tt.opts, false, os.Stdout)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			content, _ := os.ReadFile(outputPath)
+			if string(content) != tt.expected {
+				t.Errorf("expected content %q, got %q", tt.expected, content)
+			}
+		})
+	}
+}
+
+func TestFTPResume(t *testing.T) {
+	content := "0123456789abcdefghij"
+	server := newFakeFTP(t, map[string]string{"big.bin": content})
+
+	t.Run("Continue partial file", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "big.bin")
+		os.WriteFile(outputPath, []byte(content[:8]), 0o644)
+
+		if err := downloadFileWithProgress(context.Background(), server.url("ftp", "big.bin"), outputPath, &models.Options{Continue: true}, false, os.Stdout); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		got, _ := os.ReadFile(outputPath)
+		if string(got) != content {
+			t.Errorf("expected %q, got %q", content, got)
+		}
+		if !server.sawCommand("REST 8") {
+			t.Errorf("expected the download to restart at byte 8")
+		}
+	})
+
+	t.Run("Retry after dropped connection", func(t *testing.T) {
+		server.mu.Lock()
+		server.drop["big.bin"] = true
+		server.mu.Unlock()
+		outputPath := filepath.Join(t.TempDir(), "big.bin")
+		result := download(context.Background(), server.url("ftp", "big.bin"), outputPath, &models.Options{Tries: 2, WaitRetry: time.Millisecond}, false, os.Stdout)
+		if result.Error != nil {
+			t.Fatalf("expected no error, got %v", result.Error)
+		}
+		got, _ := os.ReadFile(outputPath)
+		if string(got) != content || result.Attempts != 2 {
+			t.Errorf("expected %q after 2 attempts, got %q after %d", content, got, result.Attempts)
+		}
+		if !server.sawCommand("REST 10") {
+			t.Errorf("expected the retry to restart at byte 10")
+		}
+	})
+}
+
+func TestFTPCommandInjection(t *testing.T) {
+	server := newFakeFTP(t, map[string]string{"a": "a", "x": "x"})
+
+	tests := []struct {
+		name string
+		url  string
+		opts *models.Options
+	}{
+		{name: "Path", url: server.url("ftp", "a%0d%0aDELE%20x")},
+		{name: "NUL in path", url: server.url("ftp", "a%00")},
+		{name: "User in URL", url: strings.Replace(server.url("ftp", "a"), "ftp://", "ftp://bob%0d%0aDELE%20x:pw@", 1)},
+		{name: "Password in URL", url: strings.Replace(server.url("ftp", "a"), "ftp://", "ftp://bob:pw%0aDELE%20x@", 1)},
+		{name: "Password option", url: server.url("ftp", "a"), opts: &models.Options{User: "bob", Password: "pw\r\nDELE x"}},
+	}
+
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "missing"))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			if opts == nil {
+				opts = &models.Options{}
+			}
+			err := downloadFileWithProgress(context.Background(), tt.url, filepath.Join(t.TempDir(), "out"), opts, false, os.Stdout)
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Errorf("expected a ParseError, got %v", err)
+			}
+			session, err := NewSession(opts)
+			if err != nil {
+				t.Fatalf("failed to create session: %v", err)
+			}
+			defer session.Close()
+			if _, err := ListFTP(context.Background(), session, tt.url, true); !errors.As(err, &parseErr) {
+				t.Errorf("expected a ParseError from ListFTP, got %v", err)
+			}
+		})
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.commands) != 0 {
+		t.Errorf("expected no commands to reach the server, got %q", server.commands)
+	}
+}
+
+func TestListFTP(t *testing.T) {
+	server := newFakeFTP(t, map[string]string{
+		"pub/a.txt":       "a",
+		"pub/b.txt":       "b",
+		"pub/c.iso":       "c",
+		"pub/sub/d.txt":   "d",
+		"pub/sub/x/e.txt": "e",
+	})
+
+	tests := []struct {
+		name      string
+		path      string
+		recursive bool
+		expected  []string
+	}{
+		{name: "Plain file", path: "pub/a.txt", expected: []string{"pub/a.txt"}},
+		{name: "Glob", path: "pub/*.txt", expected: []string{"pub/a.txt", "pub/b.txt"}},
+		{name: "Directory", path: "pub/", expected: []string{"pub/a.txt", "pub/b.txt", "pub/c.iso"}},
+		{name: "Recursive", path: "pub/", recursive: true, expected: []string{"pub/a.txt", "pub/b.txt", "pub/c.iso", "pub/sub/d.txt", "pub/sub/x/e.txt"}},
+		{name: "Recursive without slash", path: "pub/sub", recursive: true, expected: []string{"pub/sub/d.txt", "pub/sub/x/e.txt"}},
+	}
+
+	// Listing uses the caller's session, and leaves saving its cookies to the caller
+	savePath := filepath.Join(t.TempDir(), "cookies.txt")
+	session, err := NewSession(&models.Options{SaveCookies: savePath})
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := ListFTP(context.Background(), session, server.url("ftp", tt.path), tt.recursive)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			var expected []string
+			for _, p := range tt.expected {
+				expected = append(expected, server.url("ftp", p))
+			}
+			sort.Strings(files)
+			if strings.Join(files, "\n") != strings.Join(expected, "\n") {
+				t.Errorf("expected %v, got %v", expected, files)
+			}
+		})
+	}
+
+	if _, err := os.Stat(savePath); !os.IsNotExist(err) {
+		t.Errorf("expected listing not to save the session's cookies")
+	}
+
+	// Glob patterns in input lists download every match
+	dir := t.TempDir()
+	results := NewConcurrentDownloader(2, dir, &models.Options{}).DownloadURLs(context.Background(), []string{server.url("ftp", "pub/*.txt")})
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %s to be downloaded: %v", name, err)
+		}
+	}
+	// The sizes for the progress total come from SIZE, each file is retrieved once
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	retrieved := 0
+	for _, cmd := range server.commands {
+		if strings.HasPrefix(cmd, "RETR ") {
+			retrieved++
+		}
+	}
+	if retrieved != 2 {
+		t.Errorf("expected 2 RETR commands, got %d", retrieved)
+	}
+}
+
+func TestParseListLine(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected ftpEntry
+		ok       bool
+	}{
+		{line: "-rw-r--r--   1 ftp  ftp   1024 Jan 01 12:00 notes.txt", expected: ftpEntry{name: "notes.txt"}, ok: true},
+		{line: "drwxr-xr-x   2 ftp  ftp   4096 Jan 01 2024 releases", expected: ftpEntry{name: "releases", dir: true}, ok: true},
+		{line: "lrwxrwxrwx   1 ftp  ftp     12 Jan 01 12:00 latest -> releases/1.0", expected: ftpEntry{name: "latest"}, ok: true},
+		{line: "-rw-r--r--   1 ftp  ftp   1024 Jan 01 12:00 my file.txt", expected: ftpEntry{name: "my file.txt"}, ok: true},
+		{line: "01-16-02  11:14AM       <DIR>          epsgroup", expected: ftpEntry{name: "epsgroup", dir: true}, ok: true},
+		{line: "06-25-09  02:41PM            144700153 image.iso", expected: ftpEntry{name: "image.iso"}, ok: true},
+		{line: "total 12", ok: false},
+	}
+
+	for _, tt := range tests {
+		entry, ok := parseListLine(tt.line)
+		if ok != tt.ok || entry != tt.expected {
+			t.Errorf("parseListLine(%q) = %+v, %v; expected %+v, %v", tt.line, entry, ok, tt.expected, tt.ok)
+		}
+	}
+}
+
+func TestLocalSchemes(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "fixture.bin")
+	content := "local fixture content"
+	if err := os.WriteFile(source, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write fixture: %v", err)
+	}
+	fileURL := "file://" + filepath.ToSlash(source)
+	sum := sha256.Sum256([]byte(content))
+
+	tests := []struct {
+		name        string
+		url         string
+		opts        *models.Options
+		existing    string // Partial file already on disk
+		expected    string
+		expectError bool
+	}{
+		{name: "File", url: fileURL, opts: &models.Options{}, expected: content},
+		{name: "File with checksum and rate limit", url: fileURL, opts: &models.Options{Checksum: fmt.Sprintf("sha256:%x", sum), RateLimit: "1M"}, expected: content},
+		{name: "File resume", url: fileURL, opts: &models.Options{Continue: true}, existing: content[:5], expected: content},
+		{name: "Missing file", url: "file://" + filepath.ToSlash(filepath.Join(dir, "missing")), opts: &models.Options{}, expectError: true},
+		{name: "Directory", url: "file://" + filepath.ToSlash(dir), opts: &models.Options{}, expectError: true},
+		{name: "Remote host", url: "file://example.com/etc/passwd", opts: &models.Options{}, expectError: true},
+		{name: "Data", url: "data:,Hello%2C%20World%21", opts: &models.Options{}, expected: "Hello, World!"},
+		{name: "Data base64", url: "data:text/plain;base64,SGVsbG8sIFdvcmxkIQ", opts: &models.Options{}, expected: "Hello, World!"},
+		{name: "Unsupported scheme", url: "gopher://example.com/1", opts: &models.Options{}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputPath := filepath.Join(t.TempDir(), "out")
+			if tt.existing != "" {
+				os.WriteFile(outputPath, []byte(tt.existing), 0o644)
+			}
+			err := downloadFileWithProgress(context.Background(), tt.url, outputPath, tt.opts, false, os.Stdout)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			got, _ := os.ReadFile(outputPath)
+			if string(got) != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+
+	// Input lists mix schemes freely
+	outputDir := t.TempDir()
+	results := NewConcurrentDownloader(2, outputDir, &models.Options{}).DownloadURLs(context.Background(), []string{fileURL, "data:image/png;base64,iVBORw0KGgo="})
+	for _, result := range results {
+		if result.Error != nil {
+			t.Errorf("expected %s to download, got %v", result.URL, result.Error)
+		}
+	}
+	for _, name := range []string{"fixture.bin", "data.png"} {
+		if _, err := os.Stat(filepath.Join(outputDir, name)); err != nil {
+			t.Errorf("expected %s to be saved: %v", name, err)
+		}
+	}
+}
+
+func TestParseDataURL(t *testing.T) {
+	tests := []struct {
+		url         string
+		mediaType   string
+		data        string
+		expectError bool
+	}{
+		{url: "data:,A%20brief%20note", mediaType: "text/plain;charset=US-ASCII", data: "A brief note"},
+		{url: "data:;charset=utf-8,caf%C3%A9", mediaType: "text/plain;charset=utf-8", data: "café"},
+		{url: "data:text/html,<b>hi</b>", mediaType: "text/html", data: "<b>hi</b>"},
+		{url: "data:application/octet-stream;base64,AAEC", mediaType: "application/octet-stream", data: "\x00\x01\x02"},
+		{url: "data:text/plain;BASE64,aGk=", mediaType: "text/plain", data: "hi"},
+		{url: "data:text/plain", expectError: true},
+		{url: "data:;base64,!!!", expectError: true},
+	}
+
+	for _, tt := range tests {
+		mediaType, data, err := parseDataURL(tt.url)
+		if tt.expectError {
+			if err == nil {
+				t.Errorf("parseDataURL(%q): expected an error", tt.url)
+			}
+			continue
+		}
+		if err != nil || mediaType != tt.mediaType || string(data) != tt.data {
+			t.Errorf("parseDataURL(%q) = %q, %q, %v; expected %q, %q", tt.url, mediaType, data, err, tt.mediaType, tt.data)
+		}
+	}
+}
+
+// flakyReader returns an error once it has handed out its content, like a dropped connection
+type flakyReader struct {
+	r io.Reader
+}
+
+func (f *flakyReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, fmt.Errorf("connection reset")
+	}
+	return n, err
+}
+
+func TestRegisterFetcher(t *testing.T) {
+	content := "content served by a custom scheme"
+	modTime := time.Date(2020, time.January, 2, 3, 4, 5, 0, time.UTC)
+
+	var mu sync.Mutex
+	var offsets []int64
+	RegisterFetcher("mem", FetcherFunc(func(ctx context.Context, rawURL string, offset int64) (*Stream, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		offsets = append(offsets, offset)
+		if strings.HasSuffix(rawURL, "/missing") {
+			return nil, fmt.Errorf("no such object")
+		}
+		if strings.HasSuffix(rawURL, "/busy") && len(offsets) == 1 {
+			return nil, Retryable(fmt.Errorf("service unavailable"))
+		}
+
+		meta := Metadata{Status: "mem object", ModTime: modTime, Filename: "renamed.txt"}
+		if len(offsets) == 1 {
+			// Drop the first connection halfway through
+			body := io.NopCloser(&flakyReader{strings.NewReader(content[:10])})
+			return &Stream{Body: body, Offset: offset, Size: int64(len(content)), Metadata: meta}, nil
+		}
+		return &Stream{Body: io.NopCloser(strings.NewReader(content[offset:])), Offset: offset, Size: int64(len(content)), Metadata: meta}, nil
+	}))
+
+	tests := []struct {
+		name         string
+		url          string
+		opts         *models.Options
+		expectedName string
+		offsets      []int64
+		expectError  bool
+	}{
+		{name: "Resumes after a dropped connection", url: "mem://bucket/object", opts: &models.Options{Tries: 2, WaitRetry: time.Millisecond, Timestamping: true}, expectedName: "out", offsets: []int64{0, 10}},
+		{name: "Retries transient errors", url: "mem://bucket/busy", opts: &models.Options{Tries: 3, WaitRetry: time.Millisecond}, expectedName: "out", offsets: []int64{0, 0}},
+		{name: "Adopts suggested name", url: "mem://bucket/object", opts: &models.Options{Tries: 2, WaitRetry: time.Millisecond, ContentDisposition: true}, expectedName: "renamed.txt", offsets: []int64{0, 10}},
+		{name: "Permanent error", url: "mem://bucket/missing", opts: &models.Options{Tries: 3, WaitRetry: time.Millisecond}, offsets: []int64{0}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offsets = nil
+			dir := t.TempDir()
+			err := downloadFileWithProgress(context.Background(), tt.url, filepath.Join(dir, "out"), tt.opts, false, os.Stdout)
+			if fmt.Sprint(offsets) != fmt.Sprint(tt.offsets) {
+				t.Errorf("expected opens at offsets %v, got %v", tt.offsets, offsets)
+			}
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			outputPath := filepath.Join(dir, tt.expectedName)
+			got, _ := os.ReadFile(outputPath)
+			if string(got) != content {
+				t.Errorf("expected %q, got %q", content, got)
+			}
+			if tt.opts.Timestamping {
+				info, _ := os.Stat(outputPath)
+				if !info.ModTime().Equal(modTime) {
+					t.Errorf("expected modification time %v, got %v", modTime, info.ModTime())
+				}
+			}
+		})
+	}
+
+	// Input lists don't open registered schemes just to learn the size
+	offsets = nil
+	results := NewConcurrentDownloader(1, t.TempDir(), &models.Options{Tries: 2, WaitRetry: time.Millisecond}).DownloadURLs(context.Background(), []string{"mem://bucket/object"})
+	if len(results) != 1 || !results[0].Success || fmt.Sprint(offsets) != "[0 10]" {
+		t.Errorf("expected a single download opened at offsets [0 10], got %v (%+v)", offsets, results)
+	}
+
+	if !Supported("mem://bucket/object") || Supported("gopher://example.com/") {
+		t.Errorf("expected only registered schemes to be supported")
+	}
+}
+
+func TestSessionOpen(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "fixture.txt")
+	os.WriteFile(source, []byte("0123456789"), 0o644)
+
+	session, err := NewSession(models.NewOptions())
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	var fetcher Fetcher = session
+
+	s, err := fetcher.Open(context.Background(), "file://"+filepath.ToSlash(source), 4)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer s.Body.Close()
+	body, _ := io.ReadAll(s.Body)
+	if s.Offset != 4 || s.Size != 10 || string(body) != "456789" {
+		t.Errorf("expected 456789 at offset 4 of 10, got %q at %d of %d", body, s.Offset, s.Size)
+	}
+	if s.Metadata.ContentType == "" || s.Metadata.ModTime.IsZero() {
+		t.Errorf("expected content type and modification time, got %+v", s.Metadata)
+	}
+}
+
+func TestCancellation(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	half := len(content) / 2
+	sent := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/busy":
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		case "/stall":
+			if r.Header.Get("Range") != "" {
+				http.ServeContent(w, r, "stall", time.Time{}, strings.NewReader(content))
+				return
+			}
+			// Send half the file, then hang until the client gives up
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write([]byte(content[:half]))
+			w.(http.Flusher).Flush()
+			sent <- struct{}{}
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+
+	t.Run("Keeps the part file for resuming", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "stall")
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-sent
+			// Interrupt once the bytes we got reached the disk
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if info, err := os.Stat(outputPath + ".part"); err == nil && info.Size() == int64(half) {
+					break
+				}
+			}
+			cancel()
+		}()
+
+		err := downloadFileWithProgress(ctx, server.URL+"/stall", outputPath, &models.Options{Tries: 3}, false, os.Stdout)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+		if fileExists(outputPath) {
+			t.Errorf("expected no final file after an interrupted download")
+		}
+		got, _ := os.ReadFile(outputPath + ".part")
+		if string(got) != content[:half] {
+			t.Fatalf("expected the first %d bytes in the .part file, got %d", half, len(got))
+		}
+
+		// A later --continue picks up where we stopped
+		if err := downloadFileWithProgress(context.Background(), server.URL+"/stall", outputPath, &models.Options{Continue: true}, false, os.Stdout); err != nil {
+			t.Fatalf("expected resume to succeed, got %v", err)
+		}
+		got, _ = os.ReadFile(outputPath)
+		if string(got) != content {
+			t.Errorf("expected the whole file after resuming, got %d bytes", len(got))
+		}
+	})
+
+	t.Run("Stops waiting between retries", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		err := downloadFileWithProgress(ctx, server.URL+"/busy", filepath.Join(t.TempDir(), "busy"), &models.Options{Tries: 5, WaitRetry: time.Minute}, false, os.Stdout)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("expected the retry wait to be cut short, took %v", elapsed)
+		}
+	})
+
+	t.Run("Starts nothing once cancelled", func(t *testing.T) {
+		outputDir := t.TempDir()
+		source := filepath.Join(t.TempDir(), "local.txt")
+		os.WriteFile(source, []byte(content), 0o644)
+		// Left behind by an earlier interrupted run
+		os.WriteFile(filepath.Join(outputDir, "local.txt.part"), []byte("earlier"), 0o644)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		results := NewConcurrentDownloader(2, outputDir, &models.Options{}).DownloadURLs(ctx, []string{"file://" + filepath.ToSlash(source), server.URL + "/busy"})
+		for _, result := range results {
+			if !errors.Is(result.Error, context.Canceled) {
+				t.Errorf("expected %s to be cancelled, got %v", result.URL, result.Error)
+			}
+		}
+		got, _ := os.ReadFile(filepath.Join(outputDir, "local.txt.part"))
+		if string(got) != "earlier" {
+			t.Errorf("expected the earlier .part file to be left alone, got %q", got)
+		}
+	})
+}
+
+func TestClient(t *testing.T) {
+	var busy atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" || r.UserAgent() != "embedder/1.0" {
+			http.Error(w, "missing headers", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/busy":
+			// Fail the first request only
+			if busy.Add(1) == 1 {
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+				return
+			}
+			fallthrough
+		default:
+			w.Write([]byte("content of " + r.URL.Path))
+		}
+	}))
+	defer server.Close()
+
+	cliOpts := &models.Options{Headers: []string{"X-Token: secret"}}
+	var mu sync.Mutex
+	var events []Event
+	client, err := NewClient(
+		WithOptions(cliOpts),
+		WithUserAgent("embedder/1.0"),
+		WithHeader("X-Extra", "1"),
+		WithRateLimit(1<<20),
+		WithRetries(3, time.Millisecond),
+		WithConcurrency(2),
+		WithEventHandler(func(e Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, e)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer client.Close()
+	if len(cliOpts.Headers) != 1 {
+		t.Errorf("expected the client to leave the given options alone, got headers %v", cliOpts.Headers)
+	}
+
+	dir := t.TempDir()
+	resp, err := client.Do(context.Background(), &Request{URL: server.URL + "/file.txt", Dir: dir})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if resp.OutputPath != filepath.Join(dir, "file.txt") || resp.Size != int64(len("content of /file.txt")) || resp.Attempts != 1 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if types := eventTypes(events); types[0] != EventStart || types[len(types)-1] != EventDone {
+		t.Errorf("expected start ... done events, got %v", types)
+	}
+
+	// Streaming to a writer
+	var buf bytes.Buffer
+	if _, err := client.Do(context.Background(), &Request{URL: server.URL + "/stream", Writer: &buf}); err != nil || buf.String() != "content of /stream" {
+		t.Errorf("expected the body in the writer, got %q (%v)", buf.String(), err)
+	}
+
+	// Checksum mismatches are typed
+	_, err = client.Do(context.Background(), &Request{URL: server.URL + "/sum", Dir: dir, Checksum: "md5:00000000000000000000000000000000"})
+	var checksumErr *ChecksumError
+	if !errors.As(err, &checksumErr) || checksumErr.Algorithm != "md5" {
+		t.Errorf("expected a ChecksumError, got %v", err)
+	}
+
+	// Batches keep the order of the requests
+	events = nil
+	responses := client.DoAll(context.Background(), []*Request{
+		{URL: server.URL + "/a", Dir: dir},
+		{URL: server.URL + "/missing", Dir: dir},
+		{URL: server.URL + "/busy", Dir: dir},
+	})
+	if len(responses) != 3 || responses[0].Err != nil || responses[2].Err != nil {
+		t.Fatalf("expected /a and /busy to succeed, got %+v", responses)
+	}
+	var httpErr *HTTPError
+	if !errors.As(responses[1].Err, &httpErr) || httpErr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected an HTTPError with status 404, got %v", responses[1].Err)
+	}
+	if responses[2].Attempts != 2 {
+		t.Errorf("expected /busy to take 2 attempts, got %d", responses[2].Attempts)
+	}
+	retried := false
+	for _, e := range events {
+		if e.Type == EventRetry && strings.HasSuffix(e.URL, "/busy") && e.Attempt == 2 && e.Err != nil {
+			retried = true
+		}
+	}
+	if !retried {
+		t.Errorf("expected a retry event for /busy, got %v", eventTypes(events))
+	}
+
+	if _, err := NewClient(WithOptions(&models.Options{RateLimit: "fast"})); err == nil {
+		t.Errorf("expected an invalid rate limit to be rejected")
+	}
+
+	// The other options adjust WithOptions' copy even when given before it
+	reversed, err := NewClient(WithRateLimit(1<<20), WithHeader("X-Extra", "1"), WithOptions(cliOpts))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer reversed.Close()
+	if reversed.opts.RateLimit != "1048576" || strings.Join(reversed.opts.Headers, ", ") != "X-Token: secret, X-Extra: 1" {
+		t.Errorf("expected the rate limit and headers on top of the given options, got %q and %v", reversed.opts.RateLimit, reversed.opts.Headers)
+	}
+	if global := reversed.Session().limits.global; global == nil || global.Rate() != 1<<20 {
+		t.Errorf("expected the session to be limited to %d bytes per second", 1<<20)
+	}
+
+	// A shared session keeps its settings, the download options still apply
+	session, err := NewSession(models.NewOptions())
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	defer session.Close()
+	shared, err := NewClient(WithSession(session), WithHeader("X-Token", "secret"), WithUserAgent("embedder/1.0"))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if resp, err := shared.Do(context.Background(), &Request{URL: server.URL + "/shared.txt", Dir: dir}); err != nil {
+		t.Errorf("expected the headers to be sent through the shared session, got %v (%+v)", err, resp)
+	}
+	if _, err := NewClient(WithSession(session), WithRateLimit(1)); err == nil {
+		t.Errorf("expected changing the settings of a shared session to be rejected")
+	}
+}
+
+// eventTypes lists the types of events, for error messages
+func eventTypes(events []Event) []EventType {
+	var types []EventType
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestErrorTypes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/file":
+			w.Write([]byte("0123456789"))
+		case "/private":
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		case "/badrange":
+			if r.Header.Get("Range") == "" {
+				w.Write([]byte("0123456789"))
+				return
+			}
+			// Answers a resume with the start of the file
+			w.Header().Set("Content-Range", "bytes 0-9/10")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("0123456789"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret"))
+	}))
+	defer tlsServer.Close()
+
+	// A port nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := "http://" + listener.Addr().String() + "/file"
+	listener.Close()
+
+	dir := t.TempDir()
+	notADir := filepath.Join(dir, "file")
+	if err := os.WriteFile(notADir, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	partial := filepath.Join(dir, "badrange")
+	if err := os.WriteFile(partial, []byte("01234"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		url        string
+		outputPath string
+		opts       *models.Options
+		target     any
+		exitCode   int
+	}{
+		{"Not found", server.URL + "/missing", filepath.Join(dir, "missing"), &models.Options{}, new(*HTTPError), ExitServer},
+		{"Unauthorized", server.URL + "/private", filepath.Join(dir, "private"), &models.Options{}, new(*AuthError), ExitAuth},
+		{"Connection refused", refused, filepath.Join(dir, "refused"), &models.Options{Tries: 1}, new(*NetworkError), ExitNetwork},
+		{"Untrusted certificate", tlsServer.URL + "/file", filepath.Join(dir, "tls"), &models.Options{}, new(*TLSError), ExitTLS},
+		{"Bad checksum spec", server.URL + "/file", filepath.Join(dir, "checksum"), &models.Options{Checksum: "sha256"}, new(*ParseError), ExitParse},
+		{"Unwritable output", server.URL + "/file", filepath.Join(notADir, "sub", "file"), &models.Options{}, new(*IOError), ExitIO},
+		{"Wrong Content-Range", server.URL + "/badrange", partial, &models.Options{Continue: true}, new(*ProtocolError), ExitProtocol},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := DownloadFileSilent(context.Background(), tt.url, tt.outputPath, tt.opts)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if !errors.As(err, tt.target) {
+				t.Errorf("expected %T, got %T: %v", tt.target, err, err)
+			}
+			if code := ExitCode(err); code != tt.exitCode {
+				t.Errorf("expected exit code %d, got %d for %v", tt.exitCode, code, err)
+			}
+		})
+	}
+
+	// The errors of a batch stay reachable
+	err = JoinErrors("2 of 2 downloads failed", []error{&HTTPError{StatusCode: 404}, &NetworkError{errors.New("reset")}})
+	if err.Error() != "2 of 2 downloads failed" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+	if code := ExitCode(err); code != ExitNetwork {
+		t.Errorf("expected exit code %d for a batch, got %d", ExitNetwork, code)
+	}
+
+	// A batch gets the lowest status whatever the order of checks in ExitCode
+	tlsErr, networkErr := &TLSError{errors.New("bad certificate")}, &NetworkError{errors.New("reset")}
+	mixed := JoinErrors("2 of 2 downloads failed", []error{tlsErr, networkErr})
+	if code, want := ExitCode(mixed), ExitStatus(tlsErr, networkErr); code != ExitNetwork || code != want {
+		t.Errorf("expected exit code %d for a mixed batch, got %d (ExitStatus %d)", ExitNetwork, code, want)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		errs []error
+		want int
+	}{
+		{"No errors", nil, ExitSuccess},
+		{"All succeeded", []error{nil, nil}, ExitSuccess},
+		{"Generic error", []error{nil, errors.New("checksum mismatch")}, ExitGeneric},
+		{"Lowest status wins", []error{&HTTPError{StatusCode: 404}, &NetworkError{errors.New("reset")}}, ExitNetwork},
+		{"Specific status wins over generic", []error{errors.New("oops"), &HTTPError{StatusCode: 500}}, ExitServer},
+		{"Parse error first", []error{&AuthError{errors.New("denied")}, &ParseError{errors.New("bad URL")}}, ExitParse},
+		{"Skipped by limits", []error{nil, &LimitError{Reason: "quota"}}, ExitSuccess},
+		{"Skipped and failed", []error{&LimitError{Reason: "quota"}, &NetworkError{errors.New("reset")}}, ExitNetwork},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExitStatus(tt.errs...); got != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	t.Run("Shared between readers", func(t *testing.T) {
+		// Two readers of 10000 bytes share 20000 bytes per second, less the 2000 of the full bucket
+		limiter := NewLimiter(20000)
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r := newLimitedReader(context.Background(), io.NopCloser(bytes.NewReader(make([]byte, 10000))), limiter)
+				io.Copy(io.Discard, r)
+			}()
+		}
+		wg.Wait()
+		if elapsed := time.Since(start); elapsed < 800*time.Millisecond || elapsed > 2*time.Second {
+			t.Errorf("expected about 0.9s for 20000 bytes at 20000 B/s, took %v", elapsed)
+		}
+	})
+
+	t.Run("Cancelled wait", func(t *testing.T) {
+		limiter := NewLimiter(10)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		r := newLimitedReader(ctx, io.NopCloser(bytes.NewReader(make([]byte, 100))), limiter)
+		if _, err := io.Copy(io.Discard, r); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the wait to end with the context, got %v", err)
+		}
+	})
+
+	t.Run("Unlimited", func(t *testing.T) {
+		limiter := NewLimiter(0)
+		if err := limiter.WaitN(context.Background(), 1<<30); err != nil {
+			t.Errorf("expected no wait without a limit, got %v", err)
+		}
+	})
+}
+
+func TestSessionRateLimits(t *testing.T) {
+	session, err := NewSession(&models.Options{RateLimit: "1M", HostRateLimits: []string{"Slow.example.com=10k"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(session.limits.limiters("http://slow.example.com/file")); got != 2 {
+		t.Errorf("expected the global and host limiters for slow.example.com, got %d", got)
+	}
+	if got := len(session.limits.limiters("http://fast.example.com/file")); got != 1 {
+		t.Errorf("expected only the global limiter for fast.example.com, got %d", got)
+	}
+	if rate := session.limits.hosts["slow.example.com"].Rate(); rate != 10*1024 {
+		t.Errorf("expected 10k for slow.example.com, got %d", rate)
+	}
+
+	body := io.NopCloser(strings.NewReader("data"))
+	unlimited, err := NewSession(&models.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := unlimited.LimitReader(context.Background(), "http://example.com/", body); r != body {
+		t.Errorf("expected the body unchanged without rate limits")
+	}
+
+	for _, spec := range []string{"example.com", "=10k", "example.com=fast"} {
+		if _, err := NewSession(&models.Options{HostRateLimits: []string{spec}}); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestRateSchedule(t *testing.T) {
+	schedule, err := parseRateSchedule("08:00-18:00=500k, 18:00-08:00=0", 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name string
+		time time.Time
+		want int64
+	}{
+		{"Start of the day window", at(8, 0), 500 * 1024},
+		{"Afternoon", at(17, 59), 500 * 1024},
+		{"Evening", at(18, 0), 0},
+		{"Past midnight", at(3, 30), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := schedule.rateAt(tt.time); got != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+
+	// Outside every window --rate-limit applies
+	partial, err := parseRateSchedule("09:00-17:00=100k", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := partial.rateAt(at(20, 0)); got != 2048 {
+		t.Errorf("expected the base rate outside the windows, got %d", got)
+	}
+
+	for _, spec := range []string{"08:00-18:00", "8-18=1k", "08:00-25:00=1k", "08:00-18:00=fast"} {
+		if _, err := parseRateSchedule(spec, 0); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+	if _, err := NewSession(&models.Options{RateSchedule: "bogus"}); !errors.As(err, new(*ParseError)) {
+		t.Errorf("expected a ParseError for an invalid schedule, got %v", err)
+	}
+}
+
+func TestLimiterSetRate(t *testing.T) {
+	// 10000 bytes would take 100s at 100 bytes per second, until the limit is lifted
+	limiter := NewLimiter(100)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		limiter.SetRate(0)
+	}()
+
+	start := time.Now()
+	r := newLimitedReader(context.Background(), io.NopCloser(bytes.NewReader(make([]byte, 10000))), limiter)
+	if n, err := io.Copy(io.Discard, r); err != nil || n != 10000 {
+		t.Fatalf("expected 10000 bytes, got %d (%v)", n, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the transfer to speed up once the limit was lifted, took %v", elapsed)
+	}
+
+	limiter.SetRate(20000)
+	if rate := limiter.Rate(); rate != 20000 {
+		t.Errorf("expected the new rate, got %d", rate)
+	}
+}
+
+func TestDownloadLimits(t *testing.T) {
+	content := strings.Repeat("x", 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			// No Content-Length, the size only shows while reading
+			w.Write([]byte(content))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(content))
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	t.Run("File too large", func(t *testing.T) {
+		for _, path := range []string{"/sized", "/chunked"} {
+			outputPath := filepath.Join(t.TempDir(), "file")
+			err := DownloadFileSilent(context.Background(), server.URL+path, outputPath, &models.Options{MaxFileSize: "500"})
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("%s: expected a LimitError, got %v", path, err)
+			}
+			if _, err := os.Stat(outputPath); err == nil {
+				t.Errorf("%s: expected no file", path)
+			}
+			if _, err := os.Stat(outputPath + ".part"); err == nil {
+				t.Errorf("%s: expected no .part file", path)
+			}
+		}
+	})
+
+	t.Run("Skipped files are reported, not failures", func(t *testing.T) {
+		var out bytes.Buffer
+		result := download(context.Background(), server.URL+"/sized", filepath.Join(t.TempDir(), "file"), &models.Options{MaxFileSize: "500"}, true, &out)
+		if !strings.Contains(out.String(), "Skipped 1 file(s) because of download limits") {
+			t.Errorf("expected the single download to report the skipped file, got %q", out.String())
+		}
+		if code := ExitCode(result.Error); code != ExitSuccess {
+			t.Errorf("expected exit code %d for a skipped file, got %d", ExitSuccess, code)
+		}
+	})
+
+	urls := []string{server.URL + "/1", server.URL + "/2", server.URL + "/3", server.URL + "/4"}
+	tests := []struct {
+		name    string
+		opts    *models.Options
+		succeed int
+	}{
+		// A file started under the quota is finished, later ones are skipped
+		{"Quota", &models.Options{Quota: "1500"}, 2},
+		{"Max files", &models.Options{MaxFiles: 3}, 3},
+		{"No limits", &models.Options{}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := NewConcurrentDownloader(1, t.TempDir(), tt.opts).DownloadURLs(context.Background(), urls)
+			succeeded := 0
+			for _, result := range results {
+				var limitErr *LimitError
+				switch {
+				case result.Success:
+					succeeded++
+				case !errors.As(result.Error, &limitErr):
+					t.Errorf("expected %s to be skipped by a limit, got %v", result.URL, result.Error)
+				}
+			}
+			if succeeded != tt.succeed {
+				t.Errorf("expected %d downloads, got %d", tt.succeed, succeeded)
+			}
+		})
+	}
+
+	for _, opts := range []*models.Options{{Quota: "lots"}, {MaxFileSize: "-1"}, {MaxFiles: -1}} {
+		if _, err := NewSession(opts); !errors.As(err, new(*ParseError)) {
+			t.Errorf("expected a ParseError for %+v, got %v", opts, err)
+		}
+	}
+}
+
+func TestMultiProgress(t *testing.T) {
+	// The same URL twice, saved under two names
+	events := []Event{
+		{Type: EventStart, ID: 1, URL: "http://example.com/file", OutputPath: "out/a.bin"},
+		{Type: EventStart, ID: 2, URL: "http://example.com/file", OutputPath: "out/b.bin"},
+		{Type: EventProgress, ID: 1, URL: "http://example.com/file", Written: 512, Total: 1024},
+		{Type: EventDone, ID: 1, URL: "http://example.com/file", OutputPath: "out/a.bin", Written: 1024},
+		{Type: EventSkip, ID: 2, URL: "http://example.com/file", OutputPath: "out/b.bin", Reason: SkipNotModified},
+	}
+
+	t.Run("Lines when not on a terminal", func(t *testing.T) {
+		var out bytes.Buffer
+		display := NewMultiProgress(&out, 2, 2048)
+		for _, e := range events {
+			display.Handle(e)
+		}
+		display.Stop()
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		want := []string{"finished a.bin", "skipped b.bin (not modified)", "Total: 2/2 files, 1.0 KB in"}
+		if len(lines) != len(want) {
+			t.Fatalf("expected %d lines, got %q", len(want), out.String())
+		}
+		for i, line := range lines {
+			if !strings.HasPrefix(line, want[i]) {
+				t.Errorf("expected line %d to start with %q, got %q", i, want[i], line)
+			}
+		}
+		if strings.Contains(out.String(), "\x1b[") {
+			t.Errorf("expected no terminal escapes, got %q", out.String())
+		}
+	})
+
+	t.Run("Live lines on a terminal", func(t *testing.T) {
+		var out bytes.Buffer
+		display := NewMultiProgress(&out, 2, 2048)
+		display.live = true
+		display.width = 60
+		for _, e := range events[:3] {
+			display.Handle(e)
+		}
+
+		// Both downloads and the total are drawn, none wider than the terminal
+		frames := strings.Split(out.String(), "\r\x1b[J")
+		last := strings.Split(strings.TrimSuffix(frames[len(frames)-1], "\n"), "\n")
+		if len(last) != 3 {
+			t.Fatalf("expected 2 download lines and a total, got %q", last)
+		}
+		if !strings.HasPrefix(last[0], "a.bin") || !strings.HasPrefix(last[1], "b.bin") || !strings.HasPrefix(last[2], "Total 0/2 files, 2 active") {
+			t.Errorf("unexpected lines %q", last)
+		}
+		for _, line := range last {
+			if len([]rune(line)) >= 60 {
+				t.Errorf("expected lines cut to the terminal width, got %q", line)
+			}
+		}
+
+		// A finished file is printed above the remaining lines, which move up over the old ones
+		display.Handle(events[3])
+		if !strings.Contains(out.String(), "\x1b[3A\r\x1b[Jfinished a.bin\n") {
+			t.Errorf("expected the finished line to replace the live lines, got %q", out.String())
+		}
+		frames = strings.Split(out.String(), "\r\x1b[J")
+		if last := frames[len(frames)-1]; !strings.HasPrefix(last, "b.bin") || strings.Contains(last, "a.bin") {
+			t.Errorf("expected only b.bin left, got %q", last)
+		}
+		display.Handle(events[4])
+		display.Stop()
+		final := out.String()[strings.LastIndex(out.String(), "\r\x1b[J")+4:]
+		if !strings.HasPrefix(final, "Total 2/2 files, 0 active [==========----------]  50.0%") {
+			t.Errorf("expected the final total to count the finished bytes, got %q", final)
+		}
+	})
+
+	if isTerminal(&bytes.Buffer{}) {
+		t.Errorf("expected a buffer not to be a terminal")
+	}
+	if got := shorten("a-very-long-file-name.iso", 10); got != "a-very-..." {
+		t.Errorf("expected the name cut to 10 characters, got %q", got)
+	}
+}
@@ -1,147 +1,652 @@
 package downloadutils
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+	"wget/models"
 )
 
 // parseRateLimit parses rate limit string (e.g., "100k", "1M") into bytes per second
 func parseRateLimit(rate string) (int64, error) {
-	if rate == "" {
+	value, err := parseSize(rate)
+	if err != nil {
+		return 0, &ParseError{fmt.Errorf("invalid rate limit format: %v", err)}
+	}
+	return value, nil
+}
+
+// parseSize parses a number of bytes with an optional k, m or g suffix (e.g., "100k", "1M")
+func parseSize(size string) (int64, error) {
+	if size == "" {
 		return 0, nil
 	}
 
-	rate = strings.ToLower(rate)
+	digits := strings.ToLower(size)
 	var multiplier int64 = 1
 
 	// Get the unit (k, m, g) and multiply accordingly
-	unit := rate[len(rate)-1:]
+	unit := digits[len(digits)-1:]
 	switch unit {
 	case "k":
 		multiplier = 1024
-		rate = rate[:len(rate)-1]
+		digits = digits[:len(digits)-1]
 	case "m":
 		multiplier = 1024 * 1024
-		rate = rate[:len(rate)-1]
+		digits = digits[:len(digits)-1]
 	case "g":
 		multiplier = 1024 * 1024 * 1024
-		rate = rate[:len(rate)-1]
+		digits = digits[:len(digits)-1]
 	}
 
 	// Parse the numeric part
-	value, err := strconv.ParseInt(rate, 10, 64)
-	if err != nil {
-		return 0, fmt.Errorf("invalid rate limit format: %v", err)
+	value, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || value < 0 {
+		return 0, &ParseError{fmt.Errorf("invalid size %q", size)}
 	}
 
 	return value * multiplier, nil
 }
 
-// DownloadFile downloads a file from the given URL and saves it to the specified path
-func DownloadFile(url, outputPath string, rateLimit string) error {
-	return downloadFileWithProgress(url, outputPath, rateLimit, true, os.Stdout)
+// parseContentRange parses a Content-Range header (e.g., "bytes 100-199/200")
+// A total of -1 means the server did not report the full size
+func parseContentRange(header string) (start, total int64, err error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(header), "bytes ")
+	if !ok {
+		return 0, 0, &ProtocolError{fmt.Errorf("invalid Content-Range: %q", header)}
+	}
+
+	rangePart, totalPart, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, &ProtocolError{fmt.Errorf("invalid Content-Range: %q", header)}
+	}
+
+	total = -1
+	if totalPart != "*" {
+		if total, err = strconv.ParseInt(totalPart, 10, 64); err != nil {
+			return 0, 0, &ProtocolError{fmt.Errorf("invalid Content-Range total: %q", header)}
+		}
+	}
+
+	// An unsatisfied range ("*/total") has no start
+	if rangePart == "*" {
+		return -1, total, nil
+	}
+
+	startPart, _, ok := strings.Cut(rangePart, "-")
+	if !ok {
+		return 0, 0, &ProtocolError{fmt.Errorf("invalid Content-Range: %q", header)}
+	}
+	if start, err = strconv.ParseInt(startPart, 10, 64); err != nil {
+		return 0, 0, &ProtocolError{fmt.Errorf("invalid Content-Range start: %q", header)}
+	}
+
+	return start, total, nil
+}
+
+// openDownload sends the GET request, asking for the bytes after offset when resuming.
+// It returns the response together with the offset the body actually starts at.
+// A nil response means the local file is already complete.
+// With timestamping it returns ErrNotModified when the local file is up to date.
+func (t *transfer) openDownload(ctx context.Context, offset int64) (*http.Response, int64, error) {
+	req, err := NewRequest(t.method, t.url, t.body, t.opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	} else if t.conditional() && t.sink == nil {
+		AddConditionalHeaders(req, t.outputPath)
+	}
+
+	resp, err := t.session.Do(req)
+	if err != nil {
+		return nil, 0, connectionError("failed to download file", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		resp.Body.Close()
+		return nil, 0, ErrNotModified
+	case http.StatusOK:
+		// Server ignored the Range header (or we didn't send one), start from scratch
+		return resp, 0, nil
+	case http.StatusPartialContent:
+		if offset == 0 {
+			break
+		}
+		start, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			resp.Body.Close()
+			return nil, 0, &ProtocolError{fmt.Errorf("server resumed at wrong offset (wanted %d): %s", offset, resp.Header.Get("Content-Range"))}
+		}
+		return resp, offset, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		if offset == 0 {
+			break
+		}
+		resp.Body.Close()
+		_, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || total < 0 || total == offset {
+			// Nothing left to fetch
+			return nil, offset, nil
+		}
+		// Local file doesn't match the remote one, download it again
+		return t.openDownload(ctx, 0)
+	}
+
+	resp.Body.Close()
+	return nil, 0, responseError(resp)
+}
+
+// DownloadFile downloads a file from the given URL and saves it to the specified path.
+// Cancelling ctx stops the download, keeping the .part file for a later --continue.
+func DownloadFile(ctx context.Context, url, outputPath string, opts *models.Options) error {
+	return downloadFileWithProgress(ctx, url, outputPath, opts, true, os.Stdout)
 }
 
 // DownloadFileSilent downloads a file without progress output (for concurrent downloads)
-func DownloadFileSilent(url, outputPath string, rateLimit string) error {
-	return downloadFileWithProgress(url, outputPath, rateLimit, false, os.Stdout)
+func DownloadFileSilent(ctx context.Context, url, outputPath string, opts *models.Options) error {
+	return downloadFileWithProgress(ctx, url, outputPath, opts, false, os.Stdout)
 }
 
 // DownloadFileBackground downloads a file and writes progress to a log file
-func DownloadFileBackground(url, outputPath string, rateLimit string, logFile *os.File) error {
-	return downloadFileWithProgress(url, outputPath, rateLimit, true, logFile)
+func DownloadFileBackground(ctx context.Context, url, outputPath string, opts *models.Options, logFile *os.File) error {
+	return downloadFileWithProgress(ctx, url, outputPath, opts, true, logFile)
+}
+
+// downloadFileWithProgress is the internal download function that can toggle progress display.
+// With StdoutPath as outputPath the file goes to stdout and the messages to stderr.
+func downloadFileWithProgress(ctx context.Context, url, outputPath string, opts *models.Options, showProgress bool, output io.Writer) error {
+	if outputPath == StdoutPath && output == os.Stdout {
+		output = os.Stderr
+	}
+	return download(ctx, url, outputPath, opts, showProgress, output).Error
 }
 
-// downloadFileWithProgress is the internal download function that can toggle progress display
-func downloadFileWithProgress(url, outputPath string, rateLimit string, showProgress bool, output io.Writer) error {
+// download runs a transfer to completion, retrying transient failures, and reports the outcome
+func download(ctx context.Context, url, outputPath string, opts *models.Options, showProgress bool, output io.Writer) Result {
+	clientOptions := []ClientOption{WithOptions(opts)}
 	if showProgress {
+		clientOptions = append(clientOptions, WithOutput(output))
+	}
+	client, err := NewClient(clientOptions...)
+	if err != nil {
+		return Result{URL: url, Error: err, OutputPath: outputPath}
+	}
+
+	req := &Request{URL: url, OutputPath: outputPath, Checksum: client.opts.Checksum}
+	if outputPath == StdoutPath {
+		req.Writer = os.Stdout
+	}
+	resp, _ := client.Do(ctx, req)
+	result := resp.result()
+	if showProgress {
+		client.Session().ReportSkipped(output)
+	}
+
+	// Save cookies for the next run
+	if err := client.Close(); err != nil && result.Error == nil {
+		result.Success = false
+		result.Error = err
+	}
+	return result
+}
+
+// newTransfer creates a transfer for a single file with the download options opts, sending
+// its requests through session until ctx is cancelled
+func newTransfer(ctx context.Context, session *Session, opts *models.Options, url, outputPath string, showProgress bool, output io.Writer) *transfer {
+	return &transfer{
+		id:           transferIDs.Add(1),
+		ctx:          ctx,
+		url:          url,
+		outputPath:   outputPath,
+		session:      session,
+		opts:         opts,
+		showProgress: showProgress,
+		output:       output,
+		resume:       opts.Continue,
+		part:         outputPath + ".part",
+		overwrite:    opts.OutputFile != "" || opts.Continue || opts.Timestamping || opts.Mirror,
+	}
+}
+
+// transferIDs numbers the transfers, so their events can be told apart
+var transferIDs atomic.Uint64
+
+// transfer holds the state of a single file download across retries
+type transfer struct {
+	id           uint64
+	ctx          context.Context
+	url          string
+	outputPath   string
+	part         string // Temporary file the download is streamed into
+	session      *Session
+	opts         *models.Options
+	showProgress bool
+	output       io.Writer
+	resume       bool  // Bytes already on disk belong to this download
+	size         int64 // Bytes on disk after the last attempt
+	attempts     int
+	probed       bool        // Whether we already asked the server about range support
+	admitted     bool        // The download limits already counted the file
+	segments     []*segment  // Byte ranges of a segmented download, kept across retries
+	checksum     string      // Expected checksum (e.g., "sha256:<hex>"), if any
+	overwrite    bool        // Replace an existing file instead of picking a numbered name
+	skipped      string      // Why the existing file was kept (SkipExists or SkipNotModified), if it was
+	header       http.Header // Response headers of the last attempt, for timestamping
+	method       string      // HTTP method of the download request
+	body         []byte      // Request body (--post-data or --body-file), if any
+	sink         io.Writer   // Receives the body instead of a file on disk (stdout or a concatenated -O file)
+	sinkHash     hash.Hash   // Checksum of the bytes sent to sink
+	events       EventHandler
+}
+
+// run performs the download, retrying transient failures with backoff
+func (t *transfer) run() Result {
+	if t.showProgress {
 		startTime := time.Now().Format("2006-01-02 15:04:05")
-		fmt.Fprintf(output, "start at %s\n", startTime)
+		fmt.Fprintf(t.output, "start at %s\n", startTime)
+	}
+
+	// The credentials given for this download may go to its host
+	t.session.AuthorizeHost(t.url)
+	t.emit(Event{Type: EventStart})
+
+	tries := t.opts.Tries
+	if tries < 1 {
+		tries = 1
+	}
+
+	// Interrupted before we started, leave any earlier .part file alone
+	if err := t.ctx.Err(); err != nil {
+		return t.result(err)
+	}
+
+	// Don't even ask the server when --no-clobber protects an existing file
+	if t.sink == nil && t.opts.NoClobber && fileExists(t.outputPath) {
+		t.skip(SkipExists, "File '%s' already there; not retrieving.")
+		return t.result(nil)
 	}
 
-	// Create HTTP request
-	resp, err := http.Get(url)
+	// Don't start new files once the quota or the number of files is used up
+	if err := t.session.quota.check(t.url); err != nil {
+		return t.result(err)
+	}
+
+	// Read the request body once, every attempt sends the same bytes
+	body, err := requestBody(t.opts)
 	if err != nil {
-		return fmt.Errorf("failed to download file: %v", err)
+		return t.result(err)
 	}
-	defer resp.Body.Close()
+	t.body = body
+	t.method = requestMethod(t.opts, body)
 
-	// Check server response
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status: %s", resp.Status)
+	// Reject a malformed checksum before spending time on the download
+	if t.checksum != "" {
+		algo, _, err := parseChecksum(t.checksum)
+		if err != nil {
+			return t.result(err)
+		}
+		// A stream can't be read back, hash it on the way out
+		if t.sink != nil {
+			t.sinkHash, _ = newHash(algo)
+		}
 	}
 
-	if showProgress {
-		fmt.Fprintf(output, "sending request, awaiting response... status %s\n", resp.Status)
+	for {
+		t.attempts++
+		err = t.attempt()
+		if err != nil && t.ctx.Err() != nil {
+			// Interrupted, whatever reached the .part file is kept for --continue
+			err = t.ctx.Err()
+			break
+		}
+		if err == nil || t.attempts >= tries || !isRetryable(err, t.opts.RetryOnHTTPError) {
+			break
+		}
+
+		wait := retryDelay(t.attempts, t.opts.WaitRetry, err)
+		if t.showProgress {
+			fmt.Fprintf(t.output, "\n%v\nRetrying in %s (attempt %d of %d)...\n", err, wait.Round(time.Millisecond), t.attempts+1, tries)
+		}
+		t.emit(Event{Type: EventRetry, Attempt: t.attempts + 1, Delay: wait, Err: err})
+		if err = sleepContext(t.ctx, wait); err != nil {
+			break
+		}
 	}
 
-	// Get file size
-	size := resp.ContentLength
-	if showProgress {
-		fmt.Fprintf(output, "content size: %d [~%.2fMB]\n", size, float64(size)/(1024*1024))
+	if errors.Is(err, ErrNotModified) {
+		t.skip(SkipNotModified, "Server file no newer than local file '%s' -- not retrieving.")
+		return t.result(nil)
+	}
+	if err != nil {
+		// Keep only the bytes a later --continue can trust
+		if t.segments != nil {
+			os.Truncate(t.partPath(), contiguousBytes(t.segments))
+		}
+		return t.result(err)
 	}
 
-	// Create parent directory if it doesn't exist
-	if err := os.MkdirAll(filepath.Dir(outputPath), 0o755); err != nil {
-		return fmt.Errorf("failed to create directory: %v", err)
+	if t.sink != nil {
+		if t.sinkHash != nil {
+			err = verifyStreamChecksum(t.sinkHash, t.checksum)
+		}
+		return t.result(err)
 	}
 
-	if showProgress {
-		fmt.Fprintf(output, "File name: %s\n", filepath.Base(outputPath))
-		if !strings.Contains(outputPath, "wget") {
-			fmt.Fprintf(output, "saving file to: ./%s\n", outputPath)
+	// Make sure we got the bytes we were promised before the file gets its real name
+	if t.checksum != "" {
+		if _, statErr := os.Stat(t.partPath()); statErr == nil {
+			err = verifyChecksum(t.partPath(), t.checksum)
+			var checksumErr *ChecksumError
+			if errors.As(err, &checksumErr) {
+				// Bad bytes must not be resumed or mistaken for a good download
+				os.Remove(t.partPath())
+			}
 		} else {
-			fmt.Fprintf(output, "saving file to: %s\n", outputPath)
+			// Nothing new was downloaded, the final file is left alone either way
+			err = verifyChecksum(t.outputPath, t.checksum)
+		}
+		if err == nil && t.showProgress {
+			fmt.Fprintf(t.output, "checksum OK\n")
 		}
-		
 	}
 
-	// Create the file
-	out, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err == nil {
+		err = t.finalize()
+	}
+
+	// Remember the server's timestamp and ETag for the next timestamping run
+	if err == nil && t.opts.Timestamping && t.skipped == "" && t.header != nil {
+		err = ApplyTimestamps(t.outputPath, t.header)
+	}
+
+	return t.result(err)
+}
+
+// partPath returns the temporary file the download is streamed into.
+// It stays tied to the name derived from the URL so resuming works even when the server renames the file.
+func (t *transfer) partPath() string {
+	return t.part
+}
+
+// adoptServerName switches the final file name to the one suggested by the server,
+// unless the user picked the name with -O
+func (t *transfer) adoptServerName(resp *http.Response) {
+	if t.opts.OutputFile != "" {
+		return
+	}
+	if filename := serverFilename(resp, t.opts); filename != "" {
+		t.outputPath = filepath.Join(filepath.Dir(t.outputPath), filename)
+	}
+}
+
+// conditional reports whether timestamping can ask the server if the local file changed.
+// Not when the server names the file, as the local file to compare isn't known before its reply.
+func (t *transfer) conditional() bool {
+	serverNamed := t.opts.OutputFile == "" && (t.opts.ContentDisposition || t.opts.TrustServerNames)
+	return t.opts.Timestamping && !serverNamed
+}
+
+// skip records that an existing file was kept for reason, printing message with the file name
+func (t *transfer) skip(reason, message string) {
+	t.skipped = reason
+	if t.showProgress {
+		fmt.Fprintf(t.output, message+"\n", t.outputPath)
+	}
+}
+
+// finalize moves the completed .part file to its final name, applying the
+// --no-clobber, --backups or numbered-name policy if a file is already there
+func (t *transfer) finalize() error {
+	if _, err := os.Stat(t.partPath()); os.IsNotExist(err) {
+		// Nothing was downloaded, the final file was already complete
+		return nil
+	}
+
+	finalizeMu.Lock()
+	defer finalizeMu.Unlock()
+
+	if fileExists(t.outputPath) {
+		switch {
+		case t.opts.NoClobber:
+			os.Remove(t.partPath())
+			t.skip(SkipExists, "File '%s' already there; not retrieving.")
+			return nil
+		case t.opts.Backups > 0:
+			if err := RotateBackups(t.outputPath, t.opts.Backups); err != nil {
+				return err
+			}
+		case !t.overwrite:
+			t.outputPath = NextFreeName(t.outputPath)
+		}
+	}
+
+	if err := os.Rename(t.partPath(), t.outputPath); err != nil {
+		return &IOError{fmt.Errorf("failed to rename %s: %v", t.partPath(), err)}
+	}
+	return nil
+}
+
+// admit checks the file against the download limits the first time an attempt learns its
+// size (-1 if unknown), counting it as one of the files
+func (t *transfer) admit(size int64) error {
+	if t.admitted {
+		return nil
+	}
+	if err := t.session.quota.admit(t.url, size); err != nil {
+		return err
+	}
+	t.admitted = true
+	return nil
+}
+
+// newProgress starts tracking the progress of an attempt. The bar is only drawn on
+// stdout or stderr, a log file would fill up with redraws.
+func (t *transfer) newProgress(size, offset int64) *Progress {
+	progress := NewProgressFrom(size, offset)
+	progress.out = t.output
+	progress.quiet = !t.showProgress || (t.output != os.Stdout && t.output != os.Stderr)
+	if t.events != nil {
+		progress.notify = func(current, total int64) {
+			t.emit(Event{Type: EventProgress, Written: current, Total: total})
+		}
+	}
+	progress.Start()
+	return progress
+}
+
+// emit reports an event about the transfer to its handler, if any
+func (t *transfer) emit(e Event) {
+	if t.events == nil {
+		return
+	}
+	e.ID = t.id
+	e.URL = t.url
+	e.OutputPath = t.outputPath
+	if e.Attempt == 0 {
+		e.Attempt = t.attempts
+	}
+	t.events(e)
+}
+
+// result reports the outcome of the transfer
+func (t *transfer) result(err error) Result {
+	switch {
+	case err != nil:
+		t.emit(Event{Type: EventError, Written: t.size, Err: err})
+	case t.skipped != "":
+		t.emit(Event{Type: EventSkip, Reason: t.skipped})
+	default:
+		t.emit(Event{Type: EventDone, Written: t.size})
+	}
+	return Result{
+		URL:        t.url,
+		Success:    err == nil,
+		Error:      err,
+		Size:       t.size,
+		OutputPath: t.outputPath,
+		Attempts:   t.attempts,
+		Skipped:    t.skipped != "",
+	}
+}
+
+// attempt makes a single try at fetching the file
+func (t *transfer) attempt() error {
+	if t.sink != nil {
+		return t.attemptStream()
+	}
+
+	// Pick up where a previous download (or attempt) left off, preferring our .part file
+	// and falling back to a final file left by an older download when continuing
+	partPath := t.partPath()
+	resumeFrom := partPath
+	var offset int64
+	if t.resume {
+		if info, err := os.Stat(partPath); err == nil && info.Mode().IsRegular() {
+			offset = info.Size()
+		} else if info, err := os.Stat(t.outputPath); err == nil && info.Mode().IsRegular() && t.opts.Continue {
+			resumeFrom = t.outputPath
+			offset = info.Size()
+		}
+	}
+
+	// Split the file into parallel byte-range requests when asked to (plain GETs only)
+	if t.opts.Segments > 1 && offset == 0 && !t.probed && t.method == http.MethodGet && t.body == nil && isHTTP(t.url) {
+		t.probed = true
+		resp, ok := t.probeRanges()
+		if resp != nil && resp.StatusCode == http.StatusNotModified {
+			return ErrNotModified
+		}
+		if ok {
+			t.adoptServerName(resp)
+			t.header = resp.Header
+			t.segments = splitSegments(resp.ContentLength, t.opts.Segments)
+		} else if t.showProgress {
+			fmt.Fprintf(t.output, "server does not support byte ranges, downloading in a single stream\n")
+		}
+	}
+	if t.segments != nil {
+		return t.attemptSegmented()
+	}
+
+	// Cancelled by the stall detector when the download stops making progress
+	ctx, cancel := context.WithCancel(t.ctx)
+	defer cancel()
+
+	// Send the request
+	s, err := t.open(ctx, offset)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %v", err)
+		return err
 	}
-	defer out.Close()
+	if s == nil {
+		t.size = offset
+		if t.showProgress {
+			fmt.Fprintf(t.output, "The file is already fully retrieved; nothing to do.\n")
+		}
+		return nil
+	}
+	defer s.Body.Close()
+	offset = s.Offset
 
-	// Set up rate limiting if specified
-	var reader io.Reader = resp.Body
-	if rateLimit != "" {
-		rateLimitBytes, err := parseRateLimit(rateLimit)
-		if err != nil {
-			return fmt.Errorf("failed to parse rate limit: %v", err)
+	if t.showProgress {
+		fmt.Fprintf(t.output, "sending request, awaiting response... status %s\n", s.Metadata.Status)
+	}
+
+	// File size, including the part we already have
+	size := s.Size
+	if t.showProgress {
+		fmt.Fprintf(t.output, "content size: %d [~%.2fMB]\n", size, float64(size)/(1024*1024))
+		if offset > 0 {
+			fmt.Fprintf(t.output, "resuming from: %d [~%.2fMB]\n", offset, float64(offset)/(1024*1024))
 		}
-		if rateLimitBytes > 0 {
-			reader = NewRateLimitedReader(resp.Body, rateLimitBytes)
+	}
+
+	// Skip the file if the download limits don't allow it
+	if err := t.admit(size); err != nil {
+		return err
+	}
+
+	// Create parent directory if it doesn't exist
+	if err := os.MkdirAll(filepath.Dir(t.outputPath), 0o755); err != nil {
+		return &IOError{fmt.Errorf("failed to create directory: %v", err)}
+	}
+
+	if t.showProgress {
+		fmt.Fprintf(t.output, "File name: %s\n", filepath.Base(t.outputPath))
+		if !strings.Contains(t.outputPath, "wget") {
+			fmt.Fprintf(t.output, "saving file to: ./%s\n", t.outputPath)
+		} else {
+			fmt.Fprintf(t.output, "saving file to: %s\n", t.outputPath)
 		}
 	}
 
-	// Initialize progress tracking if needed
-	var progress *Progress
-	if showProgress && output == os.Stdout {
-		progress = NewProgress(size)
-		progress.Start()
-		reader = io.TeeReader(reader, progress)
+	// Create the .part file, appending when the server honored our Range request
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+		if resumeFrom != partPath {
+			if err := os.Rename(resumeFrom, partPath); err != nil {
+				return &IOError{fmt.Errorf("failed to resume %s: %v", resumeFrom, err)}
+			}
+		}
+	}
+	out, err := os.OpenFile(partPath, flags, 0o644)
+	if err != nil {
+		return &IOError{fmt.Errorf("failed to create file: %v", err)}
 	}
+	defer out.Close()
+
+	// From now on the file holds our bytes, so later attempts can resume it
+	t.resume = true
+	t.size = offset
+
+	// Pace the body with the rate limits shared by the session's downloads, counting it against the quota
+	var reader io.Reader = t.session.LimitReader(ctx, t.url, t.session.quota.reader(t.url, s.Body, offset))
+
+	// Track progress, only printing it if needed
+	progress := t.newProgress(size, offset)
+	reader = io.TeeReader(reader, progress)
+	stalled := watchStall(progress, t.opts.StallTimeout, cancel)
 
 	// Copy the response body to the file
-	_, err = io.Copy(out, reader)
+	written, err := io.Copy(out, reader)
+	t.size += written
+	if stalled() && err != nil {
+		return stallError(t.opts.StallTimeout)
+	}
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		// The file grew past --max-filesize, there is nothing to resume
+		out.Close()
+		os.Remove(partPath)
+		return err
+	}
 	if err != nil {
-		return fmt.Errorf("failed to save file: %v", err)
+		// Disk errors won't go away by asking again, dropped connections might
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			return &IOError{fmt.Errorf("failed to save file: %v", err)}
+		}
+		return &retryableError{&NetworkError{fmt.Errorf("failed to save file: %v", err)}}
 	}
 
-	if showProgress {
-		if progress != nil {
-			progress.Stop()
-		}
-		fmt.Fprintf(output, "\nDownloaded [%s]\n", url)
+	if t.showProgress {
+		progress.Stop()
+		fmt.Fprintf(t.output, "\nDownloaded [%s]\n", t.url)
 		endTime := time.Now().Format("2006-01-02 15:04:05")
-		fmt.Fprintf(output, "finished at %s\n", endTime)
+		fmt.Fprintf(t.output, "finished at %s\n", endTime)
 	}
 
 	return nil
@@ -0,0 +1,193 @@
+package downloadutils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// Exit statuses of GNU wget. With the exception of ExitGeneric, a lower status
+// takes precedence when several kinds of errors occurred.
+const (
+	ExitSuccess  = 0 // No problems occurred
+	ExitGeneric  = 1 // Generic error code
+	ExitParse    = 2 // Parse error, e.g. of a command line option or URL
+	ExitIO       = 3 // File I/O error
+	ExitNetwork  = 4 // Network failure
+	ExitTLS      = 5 // TLS verification failure
+	ExitAuth     = 6 // Username/password authentication failure
+	ExitProtocol = 7 // Protocol error
+	ExitServer   = 8 // Server issued an error response
+)
+
+// NetworkError reports a failure to reach a server, or a connection that broke or stalled
+type NetworkError struct {
+	Err error
+}
+
+func (e *NetworkError) Error() string { return e.Err.Error() }
+func (e *NetworkError) Unwrap() error { return e.Err }
+
+// TLSError reports a failed TLS handshake, such as an untrusted certificate or a pinned key mismatch
+type TLSError struct {
+	Err error
+}
+
+func (e *TLSError) Error() string { return e.Err.Error() }
+func (e *TLSError) Unwrap() error { return e.Err }
+
+// AuthError reports credentials the server refused (HTTP 401 or 407, FTP 530).
+// For HTTP it wraps the HTTPError of the response.
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string { return e.Err.Error() }
+func (e *AuthError) Unwrap() error { return e.Err }
+
+// IOError reports a failure to read or write a local file
+type IOError struct {
+	Err error
+}
+
+func (e *IOError) Error() string { return e.Err.Error() }
+func (e *IOError) Unwrap() error { return e.Err }
+
+// ParseError reports malformed input, such as a URL, an option value or a checksum
+type ParseError struct {
+	Err error
+}
+
+func (e *ParseError) Error() string { return e.Err.Error() }
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// ProtocolError reports a server reply that doesn't follow the protocol, such as a wrong Content-Range
+type ProtocolError struct {
+	Err error
+}
+
+func (e *ProtocolError) Error() string { return e.Err.Error() }
+func (e *ProtocolError) Unwrap() error { return e.Err }
+
+// FTPError reports an error reply of an FTP server (e.g., 550 for a missing file)
+type FTPError struct {
+	Code int
+	Msg  string
+}
+
+func (e *FTPError) Error() string {
+	return fmt.Sprintf("ftp: %03d %s", e.Code, e.Msg)
+}
+
+// isTLSError reports whether err comes from a TLS handshake or certificate check
+func isTLSError(err error) bool {
+	var (
+		tlsErr       *TLSError
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+	)
+	return errors.As(err, &tlsErr) || errors.As(err, &verifyErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) || errors.As(err, &recordErr) ||
+		errors.As(err, &alertErr)
+}
+
+// typeConnectionError wraps err, the failure of a connection or request caused by cause,
+// in a TLSError, an AuthError or a NetworkError depending on the cause
+func typeConnectionError(cause, err error) error {
+	var authErr *AuthError
+	switch {
+	case isTLSError(cause):
+		return &TLSError{err}
+	case errors.As(cause, &authErr):
+		return &AuthError{err}
+	}
+	return &NetworkError{err}
+}
+
+// connectionError classifies a failed request or connection, prefixing its message with what failed.
+// TLS and authentication failures and unknown hosts are final, other network errors are worth another try.
+func connectionError(what string, err error) error {
+	typed := typeConnectionError(err, fmt.Errorf("%s: %v", what, err))
+	if _, ok := typed.(*NetworkError); ok && !isPermanentNetworkError(err) {
+		return &retryableError{typed}
+	}
+	return typed
+}
+
+// batchError reports the failures of several downloads under one message
+type batchError struct {
+	msg  string
+	errs []error
+}
+
+func (e *batchError) Error() string   { return e.msg }
+func (e *batchError) Unwrap() []error { return e.errs }
+
+// JoinErrors combines the errors of several downloads into one with the message msg.
+// errors.As and ExitCode look through it at the individual errors.
+func JoinErrors(msg string, errs []error) error {
+	return &batchError{msg: msg, errs: errs}
+}
+
+// ExitCode returns the wget exit status for the outcome of a download.
+// Checksum mismatches and other errors wget has no status for are generic errors.
+// A batch of errors (see JoinErrors) gets the combined status of ExitStatus. Files skipped
+// because of the download limits are listed in a report rather than treated as failures.
+func ExitCode(err error) int {
+	if batch, ok := err.(interface{ Unwrap() []error }); ok {
+		return ExitStatus(batch.Unwrap()...)
+	}
+	var (
+		parseErr    *ParseError
+		ioErr       *IOError
+		tlsErr      *TLSError
+		networkErr  *NetworkError
+		authErr     *AuthError
+		protocolErr *ProtocolError
+		httpErr     *HTTPError
+		ftpErr      *FTPError
+		limitErr    *LimitError
+	)
+	switch {
+	case err == nil, errors.As(err, &limitErr):
+		return ExitSuccess
+	case errors.As(err, &parseErr):
+		return ExitParse
+	case errors.As(err, &ioErr):
+		return ExitIO
+	case errors.As(err, &tlsErr):
+		return ExitTLS
+	case errors.As(err, &networkErr):
+		return ExitNetwork
+	case errors.As(err, &authErr):
+		return ExitAuth
+	case errors.As(err, &protocolErr):
+		return ExitProtocol
+	case errors.As(err, &httpErr), errors.As(err, &ftpErr):
+		return ExitServer
+	}
+	return ExitGeneric
+}
+
+// ExitStatus combines the outcomes of several downloads into one exit status the way
+// wget does: the lowest status wins, except that ExitGeneric only wins over success.
+func ExitStatus(errs ...error) int {
+	status := ExitSuccess
+	for _, err := range errs {
+		code := ExitCode(err)
+		switch {
+		case code == ExitSuccess:
+			// Nothing to report
+		case status == ExitSuccess, status == ExitGeneric:
+			status = code
+		case code != ExitGeneric && code < status:
+			status = code
+		}
+	}
+	return status
+}
@@ -0,0 +1,225 @@
+package downloadutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stream is an opened download: the body from Offset on, and what we know about the file
+type Stream struct {
+	Body     io.ReadCloser
+	Offset   int64 // Where the body starts in the file
+	Size     int64 // Size of the whole file, or -1 if unknown
+	Metadata Metadata
+}
+
+// Metadata describes the file behind a Stream. Any field may be left empty.
+type Metadata struct {
+	Status      string    // Server status shown to the user (e.g., "200 OK")
+	ContentType string    // Media type of the file
+	ModTime     time.Time // Last modification time, applied to the saved file with --timestamping
+	Filename    string    // Name suggested by the server, used with --content-disposition or --trust-server-names
+}
+
+// Fetcher opens URLs of the schemes it is registered for. Open starts reading the file at offset;
+// it may start earlier (Offset 0 if it can't seek) but never later. It returns a nil Stream when
+// offset is already the end of the file. Wrap transient errors with Retryable so they are retried.
+type Fetcher interface {
+	Open(ctx context.Context, rawURL string, offset int64) (*Stream, error)
+}
+
+// FetcherFunc adapts a function to the Fetcher interface
+type FetcherFunc func(ctx context.Context, rawURL string, offset int64) (*Stream, error)
+
+// Open calls f(ctx, rawURL, offset)
+func (f FetcherFunc) Open(ctx context.Context, rawURL string, offset int64) (*Stream, error) {
+	return f(ctx, rawURL, offset)
+}
+
+// opener fetches a URL for a transfer, starting at offset.
+// A nil stream means the local file is already complete.
+type opener func(t *transfer, ctx context.Context, offset int64) (*Stream, error)
+
+// openers dispatches each URL scheme to the code fetching it
+var (
+	openersMu sync.RWMutex
+	openers   = map[string]opener{
+		"http":  (*transfer).openHTTP,
+		"https": (*transfer).openHTTP,
+		"ftp":   (*transfer).openFTP,
+		"ftps":  (*transfer).openFTP,
+		"file":  (*transfer).openFile,
+		"data":  (*transfer).openData,
+	}
+	// sizers look up the size of a file without fetching it, for the schemes that can do it cheaply
+	sizers = map[string]func(t *transfer, ctx context.Context) int64{
+		"ftp":  (*transfer).sizeFTP,
+		"ftps": (*transfer).sizeFTP,
+		"file": (*transfer).sizeByOpening,
+		"data": (*transfer).sizeByOpening,
+	}
+)
+
+// RegisterFetcher makes downloads, input lists and mirrors fetch URLs of scheme with f,
+// replacing any built-in support for it. Progress, rate limiting, retries, resuming
+// and checksums work the same as for the built-in schemes.
+func RegisterFetcher(scheme string, f Fetcher) {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+	openers[strings.ToLower(scheme)] = func(t *transfer, ctx context.Context, offset int64) (*Stream, error) {
+		return f.Open(ctx, t.url, offset)
+	}
+	// Opening might mean a whole transfer, so sizes of the scheme are no longer looked up
+	delete(sizers, strings.ToLower(scheme))
+}
+
+// Supported reports whether rawURL has a scheme that downloads can fetch
+func Supported(rawURL string) bool {
+	openersMu.RLock()
+	defer openersMu.RUnlock()
+	_, ok := openers[urlScheme(rawURL)]
+	return ok
+}
+
+// urlScheme returns the lower-cased scheme of a URL
+func urlScheme(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Scheme)
+}
+
+// isHTTP reports whether rawURL is an http:// or https:// URL
+func isHTTP(rawURL string) bool {
+	scheme := urlScheme(rawURL)
+	return scheme == "http" || scheme == "https"
+}
+
+// open starts fetching the file from offset with the opener registered for its scheme
+func (t *transfer) open(ctx context.Context, offset int64) (*Stream, error) {
+	scheme := urlScheme(t.url)
+	openersMu.RLock()
+	fn, ok := openers[scheme]
+	openersMu.RUnlock()
+	if !ok {
+		return nil, &ParseError{fmt.Errorf("unsupported protocol scheme %q", scheme)}
+	}
+	s, err := fn(t, ctx, offset)
+	if err != nil || s == nil {
+		return s, err
+	}
+	t.adoptMetadata(s.Metadata)
+	s.Body = &contextReader{ctx: ctx, ReadCloser: s.Body}
+	return s, nil
+}
+
+// statSize returns the size of the file if it can be learned without fetching it, or -1
+func (t *transfer) statSize(ctx context.Context) int64 {
+	openersMu.RLock()
+	fn, ok := sizers[urlScheme(t.url)]
+	openersMu.RUnlock()
+	if !ok {
+		return -1
+	}
+	return fn(t, ctx)
+}
+
+// sizeByOpening opens the file to learn its size, for schemes where opening reads nothing
+func (t *transfer) sizeByOpening(ctx context.Context) int64 {
+	st, err := t.open(ctx, 0)
+	if err != nil || st == nil {
+		return -1
+	}
+	st.Body.Close()
+	return st.Size
+}
+
+// contextReader stops reading once ctx is done, for bodies such as local files that don't watch it themselves
+type contextReader struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (r *contextReader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(b)
+}
+
+// adoptMetadata applies what a non-HTTP stream tells about the file: its suggested name
+// and modification time. HTTP responses are handled by openHTTP itself.
+func (t *transfer) adoptMetadata(m Metadata) {
+	if m.Filename != "" && t.opts.OutputFile == "" && (t.opts.ContentDisposition || t.opts.TrustServerNames) {
+		if filename := SanitizeFilename(m.Filename); filename != "" {
+			t.outputPath = filepath.Join(filepath.Dir(t.outputPath), filename)
+		}
+	}
+	if t.header == nil && !m.ModTime.IsZero() {
+		t.header = http.Header{"Last-Modified": {m.ModTime.UTC().Format(http.TimeFormat)}}
+	}
+}
+
+// openHTTP sends the HTTP request for the file, adopting the server's file name and headers
+func (t *transfer) openHTTP(ctx context.Context, offset int64) (*Stream, error) {
+	resp, offset, err := t.openDownload(ctx, offset)
+	if err != nil || resp == nil {
+		return nil, err
+	}
+	t.adoptServerName(resp)
+	t.header = resp.Header
+
+	size := resp.ContentLength
+	if size >= 0 {
+		size += offset
+	}
+	return &Stream{Body: resp.Body, Offset: offset, Size: size, Metadata: Metadata{
+		Status:      resp.Status,
+		ContentType: resp.Header.Get("Content-Type"),
+	}}, nil
+}
+
+// Open fetches rawURL from offset with the session's settings, so a Session is itself a
+// Fetcher for every registered scheme
+func (s *Session) Open(ctx context.Context, rawURL string, offset int64) (*Stream, error) {
+	t := newTransfer(ctx, s, s.opts, rawURL, "", false, io.Discard)
+	t.method = http.MethodGet
+	s.AuthorizeHost(rawURL)
+	return t.open(ctx, offset)
+}
+
+// Fetch reads the whole content of a URL of any supported scheme, returning it with its media type.
+// It counts against the session's download limits like any other download.
+func (s *Session) Fetch(ctx context.Context, rawURL string) ([]byte, string, error) {
+	st, err := s.Open(ctx, rawURL, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	if st == nil {
+		return nil, "", nil
+	}
+	defer st.Body.Close()
+
+	admitted, err := s.Admit(rawURL, st.Size, st.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := io.ReadAll(s.LimitReader(ctx, rawURL, admitted))
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return nil, "", err
+	}
+	if err != nil {
+		return nil, "", &NetworkError{fmt.Errorf("failed to read %s: %v", rawURL, err)}
+	}
+	return body, st.Metadata.ContentType, nil
+}
@@ -0,0 +1,73 @@
+package downloadutils
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"wget/models"
+)
+
+// SanitizeFilename strips any directory components from name and replaces characters
+// that aren't allowed in file names. It returns "" when nothing usable is left.
+func SanitizeFilename(name string) string {
+	// Treat both kinds of separators as directories so "..\evil" can't escape either
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." || name == "/" {
+		return ""
+	}
+
+	// Clean filename (replace invalid characters)
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`<>:"/\|?*`, r) || r < 0x20 {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// FilenameFromURL derives a local file name from the path of a URL
+func FilenameFromURL(rawURL string) (string, error) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return "", &ParseError{fmt.Errorf("invalid URL: %v", err)}
+	}
+
+	// data: URLs have no path, name them after their media type
+	if strings.EqualFold(parsedURL.Scheme, "data") {
+		return dataFilename(rawURL), nil
+	}
+
+	// Get filename from URL path
+	if filename := SanitizeFilename(parsedURL.Path); filename != "" {
+		return filename, nil
+	}
+	return "index.html", nil
+}
+
+// serverFilename picks the file name the server suggests for a response:
+// the Content-Disposition header (--content-disposition) or the URL we were
+// redirected to (--trust-server-names). It returns "" if neither applies.
+func serverFilename(resp *http.Response, opts *models.Options) string {
+	if opts.ContentDisposition {
+		if header := resp.Header.Get("Content-Disposition"); header != "" {
+			// ParseMediaType also decodes RFC 5987 filename* parameters into "filename"
+			if _, params, err := mime.ParseMediaType(header); err == nil {
+				if filename := SanitizeFilename(params["filename"]); filename != "" {
+					return filename
+				}
+			}
+		}
+	}
+
+	if opts.TrustServerNames && resp.Request != nil && resp.Request.URL != nil {
+		if filename := SanitizeFilename(resp.Request.URL.Path); filename != "" {
+			return filename
+		}
+	}
+
+	return ""
+}
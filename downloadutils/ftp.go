@@ -0,0 +1,535 @@
+package downloadutils
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxFTPDepth stops recursive listings from following directory loops forever
+const maxFTPDepth = 20
+
+// ftpConn is a logged in control connection to an FTP server
+type ftpConn struct {
+	conn      net.Conn
+	text      *textproto.Conn
+	session   *Session
+	tlsConfig *tls.Config // Set for FTPS, data connections are protected too
+}
+
+// ftpEntry is a file or directory in an FTP listing
+type ftpEntry struct {
+	name string
+	dir  bool
+}
+
+// IsFTP reports whether rawURL is an ftp:// or ftps:// URL
+func IsFTP(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (strings.EqualFold(u.Scheme, "ftp") || strings.EqualFold(u.Scheme, "ftps"))
+}
+
+// hasGlob reports whether a path contains shell glob characters
+func hasGlob(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// ftpPath returns the path of an FTP URL relative to the login directory
+func ftpPath(u *url.URL) string {
+	return strings.TrimPrefix(u.Path, "/")
+}
+
+// validFTPArgument reports whether s can go into a control connection command: a CR, LF or
+// NUL in it would end the command early and let the rest pass as another one
+func validFTPArgument(s string) bool {
+	return !strings.ContainsAny(s, "\r\n\x00")
+}
+
+// ftpError turns FTP failures into typed errors, marking transient ones (4xx replies
+// and dropped connections) as retryable
+func ftpError(err error) error {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		replyErr := &FTPError{Code: protoErr.Code, Msg: protoErr.Msg}
+		switch {
+		case protoErr.Code == 530:
+			// Not logged in
+			return &AuthError{replyErr}
+		case protoErr.Code >= 400 && protoErr.Code < 500:
+			return &retryableError{replyErr}
+		}
+		return replyErr
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || isTLSError(err) {
+		return connectionError("ftp", err)
+	}
+	return err
+}
+
+// dialFTP connects and logs in to the server of an ftp:// or ftps:// (explicit TLS) URL
+func dialFTP(ctx context.Context, session *Session, u *url.URL) (*ftpConn, error) {
+	user, password := "anonymous", "-wget@"
+	if creds := session.auth.credentialsFor(u); creds != nil && creds.user != "" {
+		user, password = creds.user, creds.password
+	}
+	switch {
+	case !validFTPArgument(ftpPath(u)):
+		return nil, &ParseError{fmt.Errorf("ftp: invalid character in path %q", u.Path)}
+	case !validFTPArgument(user) || !validFTPArgument(password):
+		return nil, &ParseError{errors.New("ftp: invalid character in user name or password")}
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+	conn, err := session.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &ftpConn{conn: conn, text: textproto.NewConn(conn), session: session}
+
+	if _, _, err := c.text.ReadResponse(2); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	if strings.EqualFold(u.Scheme, "ftps") {
+		if err := c.startTLS(ctx, u.Hostname()); err != nil {
+			c.conn.Close()
+			return nil, err
+		}
+	}
+
+	if err := c.login(user, password); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// startTLS upgrades the control connection with AUTH TLS and asks for protected data connections
+func (c *ftpConn) startTLS(ctx context.Context, host string) error {
+	if _, _, err := c.cmd(2, "AUTH TLS"); err != nil {
+		return err
+	}
+
+	config := c.session.transport.TLSClientConfig.Clone()
+	config.ServerName = host
+	// Servers commonly require data connections to resume the control connection's TLS session
+	config.ClientSessionCache = tls.NewLRUClientSessionCache(4)
+
+	tlsConn := tls.Client(c.conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	c.conn = tlsConn
+	c.text = textproto.NewConn(tlsConn)
+	c.tlsConfig = config
+
+	if _, _, err := c.cmd(2, "PBSZ 0"); err != nil {
+		return err
+	}
+	_, _, err := c.cmd(2, "PROT P")
+	return err
+}
+
+// login authenticates with the URL's credentials, --user/--password, .netrc, or anonymously
+func (c *ftpConn) login(user, password string) error {
+	code, msg, err := c.cmd(0, "USER %s", user)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case 230:
+	case 331:
+		if _, _, err := c.cmd(2, "PASS %s", password); err != nil {
+			return err
+		}
+	default:
+		return &textproto.Error{Code: code, Msg: msg}
+	}
+
+	_, _, err = c.cmd(2, "TYPE I")
+	return err
+}
+
+// cmd sends a command and reads its reply, checking the reply class unless expect is 0
+func (c *ftpConn) cmd(expect int, format string, args ...any) (int, string, error) {
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.text.ReadResponse(expect)
+}
+
+// size asks the server for the size of a file, returning -1 if it won't say
+func (c *ftpConn) size(p string) int64 {
+	_, msg, err := c.cmd(2, "SIZE %s", p)
+	if err != nil {
+		return -1
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// prepareData sets up a data connection in passive or active mode. The returned function
+// completes it once the transfer command was accepted.
+func (c *ftpConn) prepareData(ctx context.Context) (func() (net.Conn, error), error) {
+	if !c.session.opts.NoPassiveFTP {
+		addr, err := c.passiveAddr()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := c.session.dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return func() (net.Conn, error) { return c.protect(conn), nil }, nil
+	}
+
+	// Active mode: the server connects back to us
+	local := c.conn.LocalAddr().(*net.TCPAddr)
+	listener, err := net.Listen("tcp", net.JoinHostPort(local.IP.String(), "0"))
+	if err != nil {
+		return nil, err
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	if ip := local.IP.To4(); ip != nil {
+		_, _, err = c.cmd(2, "PORT %d,%d,%d,%d,%d,%d", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff)
+	} else {
+		_, _, err = c.cmd(2, "EPRT |2|%s|%d|", local.IP, port)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return func() (net.Conn, error) {
+		defer listener.Close()
+		if tcpListener, ok := listener.(*net.TCPListener); ok {
+			tcpListener.SetDeadline(time.Now().Add(c.session.dialer.connectTimeout))
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		return c.protect(conn), nil
+	}, nil
+}
+
+// passiveAddr asks for a passive data port with EPSV, falling back to PASV.
+// The address in a PASV reply is ignored in favor of the control connection's, which survives NAT.
+func (c *ftpConn) passiveAddr() (string, error) {
+	host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		return "", err
+	}
+
+	if code, msg, err := c.cmd(0, "EPSV"); err == nil && code == 229 {
+		// 229 Entering Extended Passive Mode (|||port|)
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start >= 0 && end > start+4 {
+			return net.JoinHostPort(host, msg[start+4:end]), nil
+		}
+	}
+
+	_, msg, err := c.cmd(2, "PASV")
+	if err != nil {
+		return "", err
+	}
+	// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		return "", &ProtocolError{fmt.Errorf("ftp: malformed PASV reply: %s", msg)}
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return "", &ProtocolError{fmt.Errorf("ftp: malformed PASV reply: %s", msg)}
+	}
+	p1, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+	p2, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+	if err1 != nil || err2 != nil {
+		return "", &ProtocolError{fmt.Errorf("ftp: malformed PASV reply: %s", msg)}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p1<<8|p2)), nil
+}
+
+// protect wraps a data connection in TLS for FTPS
+func (c *ftpConn) protect(conn net.Conn) net.Conn {
+	if c.tlsConfig == nil {
+		return conn
+	}
+	return tls.Client(conn, c.tlsConfig)
+}
+
+// transfer opens a data connection and sends a command using it (RETR, LIST), restarting at offset
+func (c *ftpConn) transfer(ctx context.Context, offset int64, format string, args ...any) (net.Conn, error) {
+	connect, err := c.prepareData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, _, err := c.cmd(3, "REST %d", offset); err != nil {
+			return nil, err
+		}
+	}
+	if _, _, err := c.cmd(1, format, args...); err != nil {
+		return nil, err
+	}
+	return connect()
+}
+
+// quit ends the session
+func (c *ftpConn) quit() {
+	c.cmd(0, "QUIT")
+	c.conn.Close()
+}
+
+// ftpReader is the body of a RETR, checking the server's final reply at the end
+type ftpReader struct {
+	c         *ftpConn
+	data      net.Conn
+	remaining int64 // Bytes still expected, or -1 if unknown
+	done      bool
+}
+
+// Read implements io.Reader
+func (r *ftpReader) Read(b []byte) (int, error) {
+	n, err := r.data.Read(b)
+	if r.remaining >= 0 {
+		r.remaining -= int64(n)
+	}
+	if err == io.EOF {
+		r.done = true
+		r.data.Close()
+		if _, _, replyErr := r.c.text.ReadResponse(2); replyErr != nil {
+			return n, ftpError(replyErr)
+		}
+		if r.remaining > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+// Close implements io.Closer
+func (r *ftpReader) Close() error {
+	if !r.done {
+		r.data.Close()
+		// Abandoning the transfer, the server's reply doesn't matter
+		r.c.conn.Close()
+		return nil
+	}
+	r.c.quit()
+	return nil
+}
+
+// openFTP starts retrieving an ftp:// or ftps:// file from offset
+func (t *transfer) openFTP(ctx context.Context, offset int64) (*Stream, error) {
+	u, err := url.Parse(t.url)
+	if err != nil {
+		return nil, &ParseError{fmt.Errorf("invalid URL %q: %v", t.url, err)}
+	}
+
+	c, err := dialFTP(ctx, t.session, u)
+	if err != nil {
+		return nil, ftpError(err)
+	}
+
+	p := ftpPath(u)
+	size := c.size(p)
+	if size >= 0 && offset > 0 && offset >= size {
+		if offset == size {
+			// Nothing left to fetch
+			c.quit()
+			return nil, nil
+		}
+		// Local file doesn't match the remote one, download it again
+		offset = 0
+	}
+
+	data, err := c.transfer(ctx, offset, "RETR %s", p)
+	if err != nil {
+		c.conn.Close()
+		return nil, ftpError(err)
+	}
+
+	remaining := int64(-1)
+	if size >= 0 {
+		remaining = size - offset
+	}
+	status := "RETR " + p
+	return &Stream{Body: &ftpReader{c: c, data: data, remaining: remaining}, Offset: offset, Size: size, Metadata: Metadata{Status: status}}, nil
+}
+
+// sizeFTP asks the server for the size of the file with SIZE, without transferring it
+func (t *transfer) sizeFTP(ctx context.Context) int64 {
+	u, err := url.Parse(t.url)
+	if err != nil {
+		return -1
+	}
+	c, err := dialFTP(ctx, t.session, u)
+	if err != nil {
+		return -1
+	}
+	defer c.quit()
+	return c.size(ftpPath(u))
+}
+
+// parseListLine parses a line of a Unix or MS-DOS style LIST reply
+func parseListLine(line string) (ftpEntry, bool) {
+	fields := strings.Fields(line)
+
+	// MS-DOS: 01-16-02  11:14AM  <DIR>  name
+	if len(fields) >= 4 && strings.Count(fields[0], "-") == 2 && strings.Contains(fields[1], ":") {
+		name := strings.Join(fields[3:], " ")
+		return ftpEntry{name: name, dir: fields[2] == "<DIR>"}, true
+	}
+
+	// Unix: drwxr-xr-x 2 user group 4096 Jan 1 12:00 name
+	if len(fields) < 9 || !strings.ContainsRune("-dl", rune(fields[0][0])) {
+		return ftpEntry{}, false
+	}
+	name := strings.Join(fields[8:], " ")
+	if fields[0][0] == 'l' {
+		name, _, _ = strings.Cut(name, " -> ")
+	}
+	return ftpEntry{name: name, dir: fields[0][0] == 'd'}, true
+}
+
+// list returns the entries of a directory
+func (c *ftpConn) list(ctx context.Context, dir string) ([]ftpEntry, error) {
+	data, err := c.transfer(ctx, 0, "LIST %s", dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ftpEntry
+	scanner := bufio.NewScanner(data)
+	for scanner.Scan() {
+		entry, ok := parseListLine(scanner.Text())
+		if ok && entry.name != "." && entry.name != ".." {
+			entries = append(entries, entry)
+		}
+	}
+	data.Close()
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if _, _, err := c.text.ReadResponse(2); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ListFTP returns the files an ftp:// URL stands for: the URL itself for a file, the matching
+// files for a glob pattern (e.g., ftp://host/pub/*.iso), and the files of a directory URL
+// ending in "/". With recursive, files in subdirectories are included too. The listing goes
+// through session, with its credentials and settings.
+func ListFTP(ctx context.Context, session *Session, rawURL string, recursive bool) ([]string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, &ParseError{fmt.Errorf("invalid URL %q: %v", rawURL, err)}
+	}
+	dir, pattern := path.Split(u.Path)
+	if !hasGlob(pattern) && pattern != "" && !recursive {
+		return []string{rawURL}, nil
+	}
+
+	session.AuthorizeHost(rawURL)
+
+	c, err := dialFTP(ctx, session, u)
+	if err != nil {
+		return nil, ftpError(err)
+	}
+	defer c.quit()
+
+	// A plain name might be a file or a directory, only a listing of its parent can tell
+	if pattern != "" && !hasGlob(pattern) {
+		entries, err := c.list(ctx, strings.TrimPrefix(dir, "/"))
+		if err != nil {
+			return nil, ftpError(err)
+		}
+		isDir := false
+		for _, entry := range entries {
+			if entry.name == pattern && entry.dir {
+				isDir = true
+			}
+		}
+		if !isDir {
+			return []string{rawURL}, nil
+		}
+		dir, pattern = u.Path+"/", ""
+	}
+
+	var files []string
+	var walk func(dir, pattern string, depth int) error
+	walk = func(dir, pattern string, depth int) error {
+		entries, err := c.list(ctx, strings.TrimPrefix(dir, "/"))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !validFTPArgument(entry.name) {
+				// Can't be asked for without breaking the command
+				continue
+			}
+			if pattern != "" {
+				if matched, _ := path.Match(pattern, entry.name); !matched {
+					continue
+				}
+			}
+			file := *u
+			file.Path = path.Join(dir, entry.name)
+			if !entry.dir {
+				files = append(files, file.String())
+			} else if recursive && depth < maxFTPDepth {
+				if err := walk(file.Path+"/", "", depth+1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(dir, pattern, 0); err != nil {
+		return nil, ftpError(err)
+	}
+	return files, nil
+}
+
+// expandFTP replaces FTP glob patterns and directory URLs in a list with the files they stand for
+func expandFTP(ctx context.Context, session *Session, urls []string) ([]string, []Result) {
+	var expanded []string
+	var failed []Result
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil || !IsFTP(rawURL) || (!hasGlob(path.Base(u.Path)) && !strings.HasSuffix(u.Path, "/")) {
+			expanded = append(expanded, rawURL)
+			continue
+		}
+		files, err := ListFTP(ctx, session, rawURL, false)
+		if err != nil {
+			failed = append(failed, Result{URL: rawURL, Error: err})
+			continue
+		}
+		expanded = append(expanded, files...)
+	}
+	return expanded, failed
+}
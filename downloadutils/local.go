@@ -0,0 +1,135 @@
+package downloadutils
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// openFile reads a file:// URL from the local file system
+func (t *transfer) openFile(ctx context.Context, offset int64) (*Stream, error) {
+	u, err := url.Parse(t.url)
+	if err != nil {
+		return nil, &ParseError{fmt.Errorf("invalid URL %q: %v", t.url, err)}
+	}
+	if u.Host != "" && !strings.EqualFold(u.Host, "localhost") {
+		return nil, &ParseError{fmt.Errorf("file URL %q names a remote host", t.url)}
+	}
+
+	path := filepath.FromSlash(u.Path)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, &IOError{fmt.Errorf("failed to open %s: %v", path, err)}
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, &IOError{fmt.Errorf("failed to open %s: %v", path, err)}
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, &IOError{fmt.Errorf("failed to open %s: is a directory", path)}
+	}
+
+	size := info.Size()
+	if offset > 0 && offset >= size {
+		if offset == size {
+			// Nothing left to copy
+			file.Close()
+			return nil, nil
+		}
+		// Local copy doesn't match the source, copy it again
+		offset = 0
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, &IOError{fmt.Errorf("failed to read %s: %v", path, err)}
+	}
+
+	return &Stream{Body: file, Offset: offset, Size: size, Metadata: Metadata{
+		Status:      "file " + path,
+		ContentType: mime.TypeByExtension(filepath.Ext(path)),
+		ModTime:     info.ModTime(),
+	}}, nil
+}
+
+// parseDataURL decodes a data: URL (RFC 2397) into its media type and content
+func parseDataURL(rawURL string) (string, []byte, error) {
+	scheme, rest, ok := strings.Cut(rawURL, ":")
+	if !ok || !strings.EqualFold(scheme, "data") {
+		return "", nil, &ParseError{fmt.Errorf("not a data URL: %q", rawURL)}
+	}
+	meta, payload, ok := strings.Cut(rest, ",")
+	if !ok {
+		return "", nil, &ParseError{fmt.Errorf("invalid data URL: missing comma")}
+	}
+
+	isBase64 := false
+	if trimmed, found := strings.CutSuffix(strings.ToLower(meta), ";base64"); found {
+		isBase64 = true
+		meta = meta[:len(trimmed)]
+	}
+	mediaType := meta
+	if mediaType == "" || strings.HasPrefix(mediaType, ";") {
+		mediaType = "text/plain" + mediaType
+		if !strings.Contains(mediaType, "charset=") {
+			mediaType += ";charset=US-ASCII"
+		}
+	}
+
+	data, err := url.PathUnescape(payload)
+	if err != nil {
+		return "", nil, &ParseError{fmt.Errorf("invalid data URL: %v", err)}
+	}
+	if !isBase64 {
+		return mediaType, []byte(data), nil
+	}
+
+	// Be lenient about whitespace and missing padding
+	data = strings.Join(strings.Fields(data), "")
+	decoded, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(data, "="))
+	if err != nil {
+		return "", nil, &ParseError{fmt.Errorf("invalid data URL: %v", err)}
+	}
+	return mediaType, decoded, nil
+}
+
+// openData serves the content embedded in a data: URL
+func (t *transfer) openData(ctx context.Context, offset int64) (*Stream, error) {
+	mediaType, data, err := parseDataURL(t.url)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int64(len(data))
+	if offset > 0 && offset >= size {
+		if offset == size {
+			return nil, nil
+		}
+		offset = 0
+	}
+	return &Stream{Body: io.NopCloser(bytes.NewReader(data[offset:])), Offset: offset, Size: size, Metadata: Metadata{Status: "data " + mediaType, ContentType: mediaType}}, nil
+}
+
+// dataFilename names the file saved from a data: URL after its media type (e.g., data.png)
+func dataFilename(rawURL string) string {
+	mediaType, _, err := parseDataURL(rawURL)
+	if err != nil {
+		return "data"
+	}
+	base, _, _ := mime.ParseMediaType(mediaType)
+	if base == "text/plain" {
+		return "data.txt"
+	}
+	if extensions, err := mime.ExtensionsByType(base); err == nil && len(extensions) > 0 {
+		return "data" + extensions[0]
+	}
+	return "data"
+}
@@ -0,0 +1,212 @@
+package downloadutils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	multiBarWidth   = 20                     // Width of each bar, narrower than a single download's
+	multiLabelWidth = 20                     // Room for the file name in front of a bar
+	redrawInterval  = 100 * time.Millisecond // Like a single download's bar
+)
+
+// MultiProgress shows the progress of concurrent downloads, fed with the events of a Client
+// through its Handle method. On a terminal it redraws one line per active download and a
+// total line below them; anywhere else (a pipe or a log file) it prints a line per finished
+// file and a summary at the end instead.
+type MultiProgress struct {
+	mu       sync.Mutex
+	out      io.Writer
+	live     bool // Redraw the lines in place
+	width    int  // Columns of the terminal, lines are cut to fit so redraws stay aligned
+	active   []*activeDownload
+	total    *Progress // Bytes of the whole batch
+	finished int64     // Bytes of the downloads that ended
+	files    int       // Downloads in the batch
+	done     int       // Downloads that ended, whatever the outcome
+	lines    int       // Lines drawn by the last redraw
+	lastDraw time.Time
+}
+
+// activeDownload is a download being shown by a MultiProgress
+type activeDownload struct {
+	id       uint64
+	name     string
+	progress *Progress
+}
+
+// NewMultiProgress creates a MultiProgress for a batch of files downloads totalling
+// totalBytes (0 if unknown), drawn on out
+func NewMultiProgress(out io.Writer, files int, totalBytes int64) *MultiProgress {
+	total := NewProgress(totalBytes)
+	total.width = multiBarWidth
+	total.quiet = true
+	return &MultiProgress{
+		out:   out,
+		live:  isTerminal(out),
+		width: terminalWidth(),
+		total: total,
+		files: files,
+	}
+}
+
+// isTerminal reports whether w is a terminal rather than a file or a pipe
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// terminalWidth returns the number of columns of the terminal, from $COLUMNS if set
+func terminalWidth() int {
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		return columns
+	}
+	return 80
+}
+
+// Handle updates the display with an event of a Client. It is safe to call from the
+// Client's workers at once.
+func (m *MultiProgress) Handle(e Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch e.Type {
+	case EventStart:
+		progress := NewProgress(0)
+		progress.width = multiBarWidth
+		progress.quiet = true
+		m.active = append(m.active, &activeDownload{id: e.ID, name: filepath.Base(e.OutputPath), progress: progress})
+		m.draw(true)
+	case EventProgress:
+		if d := m.find(e.ID); d != nil {
+			d.progress.set(e.Written, e.Total)
+		}
+		m.draw(false)
+	case EventDone:
+		m.end(e)
+		m.print(fmt.Sprintf("finished %s", filepath.Base(e.OutputPath)))
+	case EventSkip:
+		m.end(e)
+		m.print(fmt.Sprintf("skipped %s (%s)", filepath.Base(e.OutputPath), e.Reason))
+	case EventError:
+		// Errors are reported with the results, just drop the line
+		m.end(e)
+		m.draw(true)
+	}
+}
+
+// Stop draws the final state of the batch, or prints its summary when not on a terminal
+func (m *MultiProgress) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.live {
+		m.draw(true)
+		return
+	}
+	m.updateTotal()
+	elapsed := time.Since(m.total.started)
+	fmt.Fprintf(m.out, "Total: %d/%d files, %s in %s (%s/s)\n", m.done, m.files,
+		FormatSize(m.total.current), formatDuration(elapsed), FormatSize(int64(m.total.calculateSpeed())))
+}
+
+// find returns the active download with the id of its events. The caller holds mu.
+func (m *MultiProgress) find(id uint64) *activeDownload {
+	for _, d := range m.active {
+		if d.id == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// end removes a download that ended from the active ones. The caller holds mu.
+func (m *MultiProgress) end(e Event) {
+	for i, d := range m.active {
+		if d.id == e.ID {
+			m.active = append(m.active[:i], m.active[i+1:]...)
+			break
+		}
+	}
+	m.done++
+	if e.Type == EventDone {
+		m.finished += e.Written
+	}
+}
+
+// print writes a message line, above the live lines on a terminal. The caller holds mu.
+func (m *MultiProgress) print(msg string) {
+	if !m.live {
+		fmt.Fprintln(m.out, msg)
+		return
+	}
+	var b strings.Builder
+	m.clear(&b)
+	b.WriteString(msg + "\n")
+	m.lines = 0
+	io.WriteString(m.out, b.String())
+	m.draw(true)
+}
+
+// draw redraws the live lines, at most every redrawInterval unless forced. The caller holds mu.
+func (m *MultiProgress) draw(force bool) {
+	if !m.live || (!force && time.Since(m.lastDraw) < redrawInterval) {
+		return
+	}
+	m.lastDraw = time.Now()
+	m.updateTotal()
+
+	var b strings.Builder
+	m.clear(&b)
+	for _, d := range m.active {
+		m.line(&b, fmt.Sprintf("%-*s %s", multiLabelWidth, shorten(d.name, multiLabelWidth), d.progress.formatCompact()))
+	}
+	m.line(&b, fmt.Sprintf("Total %d/%d files, %d active %s", m.done, m.files, len(m.active), m.total.formatCompact()))
+	m.lines = len(m.active) + 1
+	io.WriteString(m.out, b.String())
+}
+
+// updateTotal adds up the bytes of the batch so far. The caller holds mu.
+func (m *MultiProgress) updateTotal() {
+	current := m.finished
+	for _, d := range m.active {
+		current += d.progress.current
+	}
+	m.total.set(current, 0)
+}
+
+// clear moves back up over the lines of the last redraw and erases them. The caller holds mu.
+func (m *MultiProgress) clear(b *strings.Builder) {
+	if m.lines > 0 {
+		fmt.Fprintf(b, "\x1b[%dA", m.lines)
+	}
+	b.WriteString("\r\x1b[J")
+}
+
+// line adds a line of the live display, cut to the terminal width so it never wraps
+func (m *MultiProgress) line(b *strings.Builder, s string) {
+	b.WriteString(shorten(s, m.width-1) + "\n")
+}
+
+// shorten cuts s to at most n characters, marking the cut with "..."
+func shorten(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	if n <= 3 {
+		return string(runes[:n])
+	}
+	return string(runes[:n-3]) + "..."
+}
@@ -0,0 +1,102 @@
+package downloadutils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// netrcEntry holds the credentials of one machine (or the default) in a .netrc file
+type netrcEntry struct {
+	machine  string // Empty for the "default" entry
+	login    string
+	password string
+}
+
+// netrcPath returns the .netrc file to use: $NETRC, or ~/.netrc
+func netrcPath() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// parseNetrc parses the machine, default, login and password tokens of a .netrc file.
+// Macro definitions (macdef) are skipped.
+func parseNetrc(data string) []netrcEntry {
+	var entries []netrcEntry
+	var current *netrcEntry
+
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		for j := 0; j < len(fields); j++ {
+			// The value of a keyword is the next token, if there is one
+			next := func() string {
+				if j+1 < len(fields) {
+					j++
+					return fields[j]
+				}
+				return ""
+			}
+
+			switch fields[j] {
+			case "machine":
+				entries = append(entries, netrcEntry{machine: next()})
+				current = &entries[len(entries)-1]
+			case "default":
+				entries = append(entries, netrcEntry{})
+				current = &entries[len(entries)-1]
+			case "login":
+				if current != nil {
+					current.login = next()
+				}
+			case "password":
+				if current != nil {
+					current.password = next()
+				}
+			case "macdef":
+				// A macro runs until the next empty line
+				for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+					i++
+				}
+				j = len(fields)
+			}
+		}
+	}
+	return entries
+}
+
+// lookupNetrc returns the .netrc credentials for host, falling back to the default entry
+func lookupNetrc(entries []netrcEntry, host string) (netrcEntry, bool) {
+	var fallback *netrcEntry
+	for i := range entries {
+		if strings.EqualFold(entries[i].machine, host) {
+			return entries[i], true
+		}
+		if entries[i].machine == "" && fallback == nil {
+			fallback = &entries[i]
+		}
+	}
+	if fallback != nil {
+		return *fallback, true
+	}
+	return netrcEntry{}, false
+}
+
+// loadNetrc reads the user's .netrc file, returning nothing if there isn't one
+func loadNetrc() []netrcEntry {
+	path := netrcPath()
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return parseNetrc(string(data))
+}
@@ -2,7 +2,10 @@ package downloadutils
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -13,8 +16,16 @@ type Progress struct {
 	lastPrint time.Time
 	started   time.Time
 	width     int
-	lastBytes int64    // Track bytes since last update
-	lastTime  time.Time // Track time since last update
+	lastBytes int64      // Track bytes since last update
+	lastTime  time.Time  // Track time since last update
+	offset    int64      // Bytes already on disk when a download is resumed
+	mu        sync.Mutex // Guards updates from parallel segments
+	lastRead  time.Time  // When bytes last arrived, for stall detection
+	quiet     bool       // Only count bytes, don't print anything
+	out       io.Writer  // Where the progress bar is drawn
+
+	// Called along with every redraw, even when quiet
+	notify func(current, total int64)
 }
 
 // formatDuration formats duration in a human-readable format
@@ -22,7 +33,7 @@ func formatDuration(d time.Duration) string {
 	if d < time.Second {
 		return "< 1s"
 	}
-	
+
 	hours := int(d.Hours())
 	minutes := int(d.Minutes()) % 60
 	seconds := int(d.Seconds()) % 60
@@ -43,18 +54,37 @@ func NewProgress(total int64) *Progress {
 		lastPrint: now,
 		started:   now,
 		lastTime:  now,
+		lastRead:  now,
+		out:       os.Stdout,
 		width:     50, // Fixed width for the progress bar
 	}
 }
 
+// NewProgressFrom creates a Progress for a resumed download that already has offset bytes
+func NewProgressFrom(total, offset int64) *Progress {
+	p := NewProgress(total)
+	p.current = offset
+	p.offset = offset
+	return p
+}
+
 // Write implements io.Writer to track progress
 func (p *Progress) Write(b []byte) (n int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	n = len(b)
 	p.current += int64(n)
+	if n > 0 {
+		p.lastRead = time.Now()
+	}
 
 	// Update progress every 100ms
 	if time.Since(p.lastPrint) >= 100*time.Millisecond {
 		p.printProgress()
+		if p.notify != nil {
+			p.notify(p.current, p.total)
+		}
 		p.lastPrint = time.Now()
 	}
 
@@ -63,15 +93,33 @@ func (p *Progress) Write(b []byte) (n int, err error) {
 
 // Start begins progress tracking
 func (p *Progress) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	now := time.Now()
 	p.started = now
 	p.lastTime = now
+	p.lastRead = now
 	p.printProgress()
 }
 
+// Idle returns how long it has been since bytes last arrived
+func (p *Progress) Idle() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return time.Since(p.lastRead)
+}
+
 // Stop ends progress tracking
 func (p *Progress) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	p.printProgress()
+	if p.notify != nil {
+		p.notify(p.current, p.total)
+	}
 	// fmt.Printf("\nTotal time: %s\n", formatDuration(time.Since(p.started)))
 }
 
@@ -84,7 +132,7 @@ func (p *Progress) calculateSpeed() float64 {
 		return 0 // Avoid division by zero
 	}
 
-	bytesDiff := p.current - p.lastBytes
+	bytesDiff := p.current - p.offset - p.lastBytes
 	speed := float64(bytesDiff) / elapsed
 
 	// Use a moving average to smooth speed fluctuations
@@ -95,60 +143,92 @@ func (p *Progress) calculateSpeed() float64 {
 	return smoothingFactor*speed + (1-smoothingFactor)*float64(p.lastBytes)/elapsed
 }
 
-
 // printProgress prints the current progress
 func (p *Progress) printProgress() {
-	var bar string
+	if p.quiet {
+		return
+	}
+	fmt.Fprintf(p.out, "\r%s", p.format())
+}
 
+// format renders the progress bar and its figures on a single line
+func (p *Progress) format() string {
 	// Calculate speed using moving average
 	speed := p.calculateSpeed()
 	elapsed := time.Since(p.started)
 
 	// Handle unknown total size
 	if p.total <= 0 {
-		// Show a moving cursor for unknown size
-		pos := (p.current / 1024) % int64(p.width)
-		left := strings.Repeat("-", int(pos))
-		mid := ">"
-		right := strings.Repeat("-", p.width-int(pos)-1)
-		bar = left + mid + right
-
-		fmt.Printf("\r[%s] %s @ %s/s Time: %s", 
-			bar,
+		return fmt.Sprintf("[%s] %s @ %s/s Time: %s",
+			p.bar(),
 			FormatSize(p.current),
 			FormatSize(int64(speed)),
 			formatDuration(elapsed),
 		)
-		return
 	}
 
-	// Calculate progress for known size
 	percent := float64(p.current) / float64(p.total) * 100
-	completed := int(float64(p.width) * float64(p.current) / float64(p.total))
-	if completed > p.width {
-		completed = p.width
-	}
-
-	bar = strings.Repeat("=", completed) + strings.Repeat("-", p.width-completed)
+	return fmt.Sprintf("[%s] %.1f%% %s/%s @ %s/s Time: %s ETA: %s",
+		p.bar(),
+		percent,
+		FormatSize(p.current),
+		FormatSize(p.total),
+		FormatSize(int64(speed)),
+		formatDuration(elapsed),
+		p.eta(speed),
+	)
+}
 
-	// Calculate ETA
-	var eta string
-	if speed > 0 {
-		remainingBytes := p.total - p.current
-		remainingTime := time.Duration(float64(remainingBytes)/speed) * time.Second
-		eta = formatDuration(remainingTime)
-	} else {
-		eta = "Unknown"
+// formatCompact renders a shorter line than format, for displays with several bars
+func (p *Progress) formatCompact() string {
+	speed := p.calculateSpeed()
+	if p.total <= 0 {
+		return fmt.Sprintf("[%s] %s @ %s/s", p.bar(), FormatSize(p.current), FormatSize(int64(speed)))
 	}
 
-	// Print progress
-	fmt.Printf("\r[%s] %.1f%% %s/%s @ %s/s Time: %s ETA: %s",
-		bar,
+	percent := float64(p.current) / float64(p.total) * 100
+	return fmt.Sprintf("[%s] %5.1f%% %s/%s @ %s/s ETA %s",
+		p.bar(),
 		percent,
 		FormatSize(p.current),
 		FormatSize(p.total),
 		FormatSize(int64(speed)),
-		formatDuration(elapsed),
-		eta,
+		p.eta(speed),
 	)
 }
+
+// bar draws the bar itself, or a moving cursor when the size is unknown
+func (p *Progress) bar() string {
+	if p.total <= 0 {
+		pos := (p.current / 1024) % int64(p.width)
+		return strings.Repeat("-", int(pos)) + ">" + strings.Repeat("-", p.width-int(pos)-1)
+	}
+
+	completed := int(float64(p.width) * float64(p.current) / float64(p.total))
+	if completed > p.width {
+		completed = p.width
+	}
+	return strings.Repeat("=", completed) + strings.Repeat("-", p.width-completed)
+}
+
+// eta estimates the time left at the given speed
+func (p *Progress) eta(speed float64) string {
+	if speed <= 0 {
+		return "Unknown"
+	}
+	remainingBytes := p.total - p.current
+	remainingTime := time.Duration(float64(remainingBytes)/speed) * time.Second
+	return formatDuration(remainingTime)
+}
+
+// set records the figures of a download whose bytes the Progress doesn't see itself,
+// such as one reported by events. A total of 0 or less leaves the known total alone.
+func (p *Progress) set(current, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.current = current
+	if total > 0 {
+		p.total = total
+	}
+}
@@ -0,0 +1,156 @@
+package downloadutils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"wget/models"
+
+	"golang.org/x/net/proxy"
+)
+
+// getenv returns the first of the environment variables that is set (e.g., http_proxy, HTTP_PROXY)
+func getenv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// parseProxyURL parses a proxy address, defaulting to an HTTP proxy when no scheme is given
+func parseProxyURL(rawURL string, opts *models.Options) (*url.URL, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, &ParseError{fmt.Errorf("invalid proxy %q", rawURL)}
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, &ParseError{fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)}
+	}
+
+	// --proxy-user and --proxy-password win over credentials in the URL
+	if opts.ProxyUser != "" {
+		u.User = url.UserPassword(opts.ProxyUser, opts.ProxyPassword)
+	}
+	return u, nil
+}
+
+// noProxyMatch reports whether host is excluded from proxying by a no_proxy list
+// ("*", host names, ".domain" suffixes, IP addresses and CIDR ranges, optionally with a port)
+func noProxyMatch(host, port, noProxy string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		// An entry with a port only matches that port
+		if entryHost, entryPort, err := net.SplitHostPort(entry); err == nil {
+			if entryPort != port {
+				continue
+			}
+			entry = entryHost
+		}
+		entry = strings.TrimPrefix(entry, "*")
+
+		if strings.HasPrefix(entry, ".") {
+			if strings.HasSuffix(host, entry) || host == entry[1:] {
+				return true
+			}
+		} else if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// configureProxy sets up the transport to go through the proxy from --proxy or the
+// http_proxy/https_proxy/all_proxy environment variables, skipping hosts listed in no_proxy.
+// HTTP proxies tunnel HTTPS with CONNECT; SOCKS5 proxies are dialed through golang.org/x/net/proxy.
+func configureProxy(transport *http.Transport, direct *dialer, opts *models.Options) error {
+	transport.Proxy = nil
+	if opts.NoProxy {
+		return nil
+	}
+
+	httpProxy, httpsProxy := opts.Proxy, opts.Proxy
+	if opts.Proxy == "" {
+		allProxy := getenv("all_proxy", "ALL_PROXY")
+		// HTTP_PROXY is ignored in CGI environments, where it can be set by a request header
+		httpProxy = getenv("http_proxy")
+		if httpProxy == "" && os.Getenv("REQUEST_METHOD") == "" {
+			httpProxy = getenv("HTTP_PROXY")
+		}
+		if httpProxy == "" {
+			httpProxy = allProxy
+		}
+		httpsProxy = getenv("https_proxy", "HTTPS_PROXY")
+		if httpsProxy == "" {
+			httpsProxy = allProxy
+		}
+	}
+	noProxy := getenv("no_proxy", "NO_PROXY")
+	if opts.Proxy == "" {
+		// Like net/http, proxies from the environment are never used for the local machine
+		noProxy += ",localhost,127.0.0.0/8,::1"
+	}
+
+	proxies := make(map[string]*url.URL)
+	for scheme, rawURL := range map[string]string{"http": httpProxy, "https": httpsProxy} {
+		if rawURL == "" {
+			continue
+		}
+		u, err := parseProxyURL(rawURL, opts)
+		if err != nil {
+			return err
+		}
+		proxies[scheme] = u
+	}
+
+	// A SOCKS5 proxy handles every connection at the dialer level
+	for _, u := range proxies {
+		if !strings.HasPrefix(u.Scheme, "socks5") {
+			continue
+		}
+		socks, err := proxy.FromURL(u, direct)
+		if err != nil {
+			return &ParseError{fmt.Errorf("invalid proxy %q: %v", u.Redacted(), err)}
+		}
+		perHost := proxy.NewPerHost(socks, direct)
+		perHost.AddFromString(noProxy)
+		transport.DialContext = perHost.DialContext
+		return nil
+	}
+
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		u := proxies[req.URL.Scheme]
+		if u == nil || noProxyMatch(req.URL.Hostname(), req.URL.Port(), noProxy) {
+			return nil, nil
+		}
+		return u, nil
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package downloadutils
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"wget/models"
+)
+
+// LimitError reports a file skipped because of --quota, --max-filesize or --max-files
+type LimitError struct {
+	URL    string
+	Reason string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("skipped: %s", e.Reason)
+}
+
+// quota enforces the download limits of a session: the total bytes (--quota), the size of
+// each file (--max-filesize) and the number of files (--max-files). Files already started
+// are finished even if they take the total past the quota, like wget does.
+type quota struct {
+	maxBytes    int64
+	maxFileSize int64
+	maxFiles    int
+
+	mu      sync.Mutex
+	bytes   int64
+	files   int
+	skipped []*LimitError
+}
+
+// newQuota creates the quota for the limit options
+func newQuota(opts *models.Options) (*quota, error) {
+	maxBytes, err := parseSize(opts.Quota)
+	if err != nil {
+		return nil, &ParseError{fmt.Errorf("invalid quota: %v", err)}
+	}
+	maxFileSize, err := parseSize(opts.MaxFileSize)
+	if err != nil {
+		return nil, &ParseError{fmt.Errorf("invalid max file size: %v", err)}
+	}
+	if opts.MaxFiles < 0 {
+		return nil, &ParseError{fmt.Errorf("invalid max files: %d", opts.MaxFiles)}
+	}
+	return &quota{maxBytes: maxBytes, maxFileSize: maxFileSize, maxFiles: opts.MaxFiles}, nil
+}
+
+// check reports whether another file may still be downloaded, without counting it
+func (q *quota) check(rawURL string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.checkLocked(rawURL, -1)
+}
+
+// admit counts a file about to be downloaded, or reports why it is skipped.
+// size is the size of the whole file, -1 if unknown.
+func (q *quota) admit(rawURL string, size int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.checkLocked(rawURL, size); err != nil {
+		return err
+	}
+	q.files++
+	return nil
+}
+
+// checkLocked applies the limits to a file. The caller holds mu.
+func (q *quota) checkLocked(rawURL string, size int64) error {
+	var reason string
+	switch {
+	case q.maxFiles > 0 && q.files >= q.maxFiles:
+		reason = fmt.Sprintf("limit of %d files reached", q.maxFiles)
+	case q.maxBytes > 0 && q.bytes >= q.maxBytes:
+		reason = fmt.Sprintf("download quota of %d bytes exceeded", q.maxBytes)
+	case q.maxFileSize > 0 && size > q.maxFileSize:
+		reason = fmt.Sprintf("file size %d exceeds the maximum of %d bytes", size, q.maxFileSize)
+	default:
+		return nil
+	}
+	return q.skipLocked(&LimitError{URL: rawURL, Reason: reason})
+}
+
+// skipLocked records a skipped file for the report. The caller holds mu.
+func (q *quota) skipLocked(err *LimitError) error {
+	q.skipped = append(q.skipped, err)
+	return err
+}
+
+// reader counts the bytes of body against the quota, and stops it once the file grows
+// past --max-filesize (for servers that didn't tell the size). offset is where body
+// starts in the file.
+func (q *quota) reader(rawURL string, body io.ReadCloser, offset int64) io.ReadCloser {
+	if q.maxBytes == 0 && q.maxFileSize == 0 {
+		return body
+	}
+	return &quotaReader{ReadCloser: body, quota: q, url: rawURL, size: offset}
+}
+
+// quotaReader counts the bytes read for a quota
+type quotaReader struct {
+	io.ReadCloser
+	quota *quota
+	url   string
+	size  int64 // Bytes of the file so far
+	err   error // Set once the file grew too large
+}
+
+// Read implements io.Reader
+func (r *quotaReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.size += int64(n)
+
+	q := r.quota
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.bytes += int64(n)
+	if q.maxFileSize > 0 && r.size > q.maxFileSize {
+		// A skipped file isn't one of the --max-files
+		q.files--
+		r.err = q.skipLocked(&LimitError{URL: r.url, Reason: fmt.Sprintf("file exceeds the maximum of %d bytes", q.maxFileSize)})
+		return n, r.err
+	}
+	return n, err
+}
+
+// report prints the files skipped because of the limits, if any
+func (q *quota) report(w io.Writer) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.skipped) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\nSkipped %d file(s) because of download limits:\n", len(q.skipped))
+	for _, err := range q.skipped {
+		fmt.Fprintf(w, "  %s: %s\n", err.URL, err.Reason)
+	}
+}
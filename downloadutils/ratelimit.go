@@ -1,60 +1,168 @@
 package downloadutils
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
+	"wget/models"
 )
 
-// RateLimitedReader wraps an io.Reader to limit its read rate
-type RateLimitedReader struct {
-	reader     io.ReadCloser
-	rateLimit  int64 // bytes per second
-	lastRead   time.Time
-	bytesRead  int64
-	windowSize time.Duration
+// Limiter paces reads with a token bucket: tokens accrue at the rate, up to a tenth of a
+// second's worth, and every byte read takes one. It is safe for concurrent use, so the
+// downloads sharing a Limiter share its rate. The rate may change while they run.
+type Limiter struct {
+	mu       sync.Mutex
+	rate     int64 // bytes per second, 0 means no limit
+	tokens   float64
+	last     time.Time
+	schedule *rateSchedule // Sets the rate by time of day, if any
 }
 
-// NewRateLimitedReader creates a new rate-limited reader
-func NewRateLimitedReader(reader io.ReadCloser, rateLimit int64) *RateLimitedReader {
-	return &RateLimitedReader{
-		reader:     reader,
-		rateLimit:  rateLimit,
-		lastRead:   time.Now(),
-		windowSize: time.Second,
+// NewLimiter creates a Limiter for rate bytes per second (0 means no limit)
+func NewLimiter(rate int64) *Limiter {
+	l := &Limiter{rate: max(rate, 0), last: time.Now()}
+	l.tokens = float64(l.burst())
+	return l
+}
+
+// newScheduledLimiter creates a Limiter whose rate follows a schedule
+func newScheduledLimiter(schedule *rateSchedule) *Limiter {
+	l := NewLimiter(schedule.rateAt(time.Now()))
+	l.schedule = schedule
+	return l
+}
+
+// Rate returns the limit in bytes per second (0 means no limit)
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.update(time.Now())
+	return l.rate
+}
+
+// SetRate changes the limit to rate bytes per second (0 means no limit). Reads in
+// progress keep going at the new rate.
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.setRate(time.Now(), rate)
+}
+
+// setRate changes the rate, keeping the tokens earned at the old one. The caller holds mu.
+func (l *Limiter) setRate(now time.Time, rate int64) {
+	rate = max(rate, 0)
+	if rate == l.rate {
+		return
 	}
+	l.refill(now)
+	wasUnlimited := l.rate == 0
+	l.rate = rate
+	if wasUnlimited {
+		l.tokens = float64(l.burst())
+	}
+	l.tokens = min(l.tokens, float64(l.burst()))
 }
 
-// Read implements io.Reader interface with rate limiting
-func (r *RateLimitedReader) Read(p []byte) (n int, err error) {
+// update applies the schedule, if any. The caller holds mu.
+func (l *Limiter) update(now time.Time) {
+	if l.schedule != nil {
+		l.setRate(now, l.schedule.rateAt(now))
+	}
+}
+
+// refill adds the tokens earned since the last refill. The caller holds mu.
+func (l *Limiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(l.rate), float64(l.burst()))
+	}
+	l.last = now
+}
+
+// burst returns the size of the bucket, a tenth of a second's worth of bytes
+func (l *Limiter) burst() int64 {
+	return max(l.rate/10, 1)
+}
+
+// chunk returns how many bytes a single read may take, 0 meaning any number
+func (l *Limiter) chunk() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.update(time.Now())
+	if l.rate == 0 {
+		return 0
+	}
+	return l.burst()
+}
+
+// reserve takes n tokens and returns how long to wait until the bucket covers them
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	now := time.Now()
-	elapsed := now.Sub(r.lastRead)
+	l.update(now)
+	if l.rate == 0 {
+		return 0
+	}
 
-	// If we've moved to a new window, reset the counter
-	if elapsed >= r.windowSize {
-		r.bytesRead = 0
-		r.lastRead = now
+	l.refill(now)
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
 	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
 
-	// Calculate how many bytes we can read in this window
-	allowedBytes := r.rateLimit - r.bytesRead
-	if allowedBytes <= 0 {
-		// We've exceeded our rate limit for this window
-		// Sleep until the next window
-		time.Sleep(r.windowSize - elapsed)
-		r.bytesRead = 0
-		r.lastRead = time.Now()
-		allowedBytes = r.rateLimit
+// WaitN blocks until n bytes may pass, or ctx is cancelled
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if wait := l.reserve(n); wait > 0 {
+		return sleepContext(ctx, wait)
 	}
+	return nil
+}
 
-	// Limit the read size to respect the rate limit
-	if int64(len(p)) > allowedBytes {
-		p = p[:allowedBytes]
+// RateLimitedReader wraps an io.Reader to limit its read rate
+type RateLimitedReader struct {
+	reader   io.ReadCloser
+	ctx      context.Context
+	limiters []*Limiter
+}
+
+// NewRateLimitedReader creates a new rate-limited reader with a limiter of its own
+func NewRateLimitedReader(reader io.ReadCloser, rateLimit int64) *RateLimitedReader {
+	return newLimitedReader(context.Background(), reader, NewLimiter(rateLimit))
+}
+
+// newLimitedReader creates a reader paced by every one of limiters, which it may share with
+// other readers. Waiting for them stops when ctx is cancelled.
+func newLimitedReader(ctx context.Context, reader io.ReadCloser, limiters ...*Limiter) *RateLimitedReader {
+	return &RateLimitedReader{reader: reader, ctx: ctx, limiters: limiters}
+}
+
+// Read implements io.Reader interface with rate limiting
+func (r *RateLimitedReader) Read(p []byte) (n int, err error) {
+	// Small reads keep the pace smooth instead of bursty
+	for _, l := range r.limiters {
+		if chunk := l.chunk(); chunk > 0 && int64(len(p)) > chunk {
+			p = p[:chunk]
+		}
 	}
 
-	// Perform the actual read
 	n, err = r.reader.Read(p)
-	r.bytesRead += int64(n)
 
+	// Wait until the slowest limiter allows the bytes we got
+	var wait time.Duration
+	for _, l := range r.limiters {
+		wait = max(wait, l.reserve(n))
+	}
+	if wait > 0 {
+		if waitErr := sleepContext(r.ctx, wait); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
 	return n, err
 }
 
@@ -62,3 +170,58 @@ func (r *RateLimitedReader) Read(p []byte) (n int, err error) {
 func (r *RateLimitedReader) Close() error {
 	return r.reader.Close()
 }
+
+// rateLimits holds the limiters of a session: one shared by all its downloads (--rate-limit,
+// or --rate-schedule) and one for each host with a limit of its own (--host-rate-limit)
+type rateLimits struct {
+	global *Limiter
+	hosts  map[string]*Limiter
+}
+
+// newRateLimits creates the limiters for the rate limit options
+func newRateLimits(opts *models.Options) (*rateLimits, error) {
+	rate, err := parseRateLimit(opts.RateLimit)
+	if err != nil {
+		return nil, &ParseError{fmt.Errorf("failed to parse rate limit: %v", err)}
+	}
+	limits := &rateLimits{hosts: make(map[string]*Limiter)}
+	if opts.RateSchedule != "" {
+		schedule, err := parseRateSchedule(opts.RateSchedule, rate)
+		if err != nil {
+			return nil, &ParseError{fmt.Errorf("failed to parse rate schedule: %v", err)}
+		}
+		limits.global = newScheduledLimiter(schedule)
+	} else if rate > 0 {
+		limits.global = NewLimiter(rate)
+	}
+
+	for _, spec := range opts.HostRateLimits {
+		host, value, ok := strings.Cut(spec, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		if !ok || host == "" {
+			return nil, &ParseError{fmt.Errorf("invalid host rate limit %q (expected HOST=RATE)", spec)}
+		}
+		rate, err := parseRateLimit(strings.TrimSpace(value))
+		if err != nil {
+			return nil, &ParseError{fmt.Errorf("failed to parse rate limit of %s: %v", host, err)}
+		}
+		if rate > 0 {
+			limits.hosts[host] = NewLimiter(rate)
+		}
+	}
+	return limits, nil
+}
+
+// limiters returns the limiters that apply to a download of rawURL
+func (r *rateLimits) limiters(rawURL string) []*Limiter {
+	var limiters []*Limiter
+	if r.global != nil {
+		limiters = append(limiters, r.global)
+	}
+	if u, err := url.Parse(rawURL); err == nil {
+		if l := r.hosts[strings.ToLower(u.Hostname())]; l != nil {
+			limiters = append(limiters, l)
+		}
+	}
+	return limiters
+}
@@ -0,0 +1,84 @@
+package downloadutils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"wget/models"
+)
+
+// DefaultUserAgent identifies the downloader when no --user-agent is given
+const DefaultUserAgent = "Wget/1.21.4 (go)"
+
+// NewRequest creates an HTTP request carrying the user's --header and --user-agent settings.
+// body may be nil for requests without one.
+func NewRequest(method, url string, body []byte, opts *models.Options) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return nil, &ParseError{fmt.Errorf("failed to create request: %v", err)}
+	}
+
+	req.Header.Set("User-Agent", DefaultUserAgent)
+	if opts == nil {
+		return req, nil
+	}
+	if opts.UserAgent != "" {
+		req.Header.Set("User-Agent", opts.UserAgent)
+	}
+
+	for _, header := range opts.Headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return nil, &ParseError{fmt.Errorf("invalid header %q, expected NAME: VALUE", header)}
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+
+		// The Host header lives on the request itself
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Add(name, value)
+	}
+
+	// Form-encoded like wget's --post-data unless told otherwise
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	return req, nil
+}
+
+// requestBody returns the body to send with downloads (--post-data or --body-file), or nil
+func requestBody(opts *models.Options) ([]byte, error) {
+	if opts.BodyFile != "" {
+		body, err := os.ReadFile(opts.BodyFile)
+		if err != nil {
+			return nil, &IOError{fmt.Errorf("failed to read body file: %v", err)}
+		}
+		return body, nil
+	}
+	if opts.PostData != "" {
+		return []byte(opts.PostData), nil
+	}
+	return nil, nil
+}
+
+// requestMethod returns the method for downloads: --method, or POST when there is a body
+func requestMethod(opts *models.Options, body []byte) string {
+	if opts.Method != "" {
+		return strings.ToUpper(opts.Method)
+	}
+	if body != nil {
+		return http.MethodPost
+	}
+	return http.MethodGet
+}
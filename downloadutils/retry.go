@@ -0,0 +1,154 @@
+package downloadutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// defaultWaitRetry caps the backoff between retries when --waitretry isn't given
+const defaultWaitRetry = 10 * time.Second
+
+// retryableStatusCodes are the HTTP statuses that are always worth another try
+var retryableStatusCodes = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// HTTPError reports a response with an unexpected status code. Retrieve it from a failed
+// download with errors.As.
+type HTTPError struct {
+	Status     string
+	StatusCode int
+	RetryAfter time.Duration // Delay requested by the server, if any
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("bad status: %s", e.Status)
+}
+
+// newHTTPStatusError builds an HTTPError from a response, honoring Retry-After on 429/503
+func newHTTPStatusError(resp *http.Response) *HTTPError {
+	err := &HTTPError{
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		err.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	}
+	return err
+}
+
+// retryableError marks a transient failure such as a dropped connection
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(header); err == nil && when.After(now) {
+		return when.Sub(now)
+	}
+	return 0
+}
+
+// responseError describes a response with an unexpected status code. Refused
+// credentials (401 and 407) are authentication errors.
+func responseError(resp *http.Response) error {
+	err := newHTTPStatusError(resp)
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusProxyAuthRequired {
+		return &AuthError{err}
+	}
+	return err
+}
+
+// isPermanentNetworkError reports whether a request error will not go away on retry,
+// such as an unknown host
+func isPermanentNetworkError(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// isRetryable reports whether err is a transient failure worth another attempt.
+// extraCodes lists additional HTTP statuses to retry (--retry-on-http-error).
+func isRetryable(err error, extraCodes []int) bool {
+	var statusErr *HTTPError
+	if errors.As(err, &statusErr) {
+		return slices.Contains(retryableStatusCodes, statusErr.StatusCode) ||
+			slices.Contains(extraCodes, statusErr.StatusCode)
+	}
+
+	var retryErr *retryableError
+	return errors.As(err, &retryErr)
+}
+
+// retryDelay returns how long to wait before the next attempt.
+// It doubles a one second base delay each attempt, capped at maxWait, with jitter,
+// unless the server asked for a specific delay via Retry-After. That is capped at maxWait too.
+func retryDelay(attempt int, maxWait time.Duration, err error) time.Duration {
+	if maxWait <= 0 {
+		maxWait = defaultWaitRetry
+	}
+
+	var statusErr *HTTPError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		return min(statusErr.RetryAfter, maxWait)
+	}
+
+	delay := time.Second << min(attempt-1, 30)
+	if delay > maxWait {
+		delay = maxWait
+	}
+
+	// Jitter the delay between half and the full value so retries don't synchronize
+	half := delay / 2
+	return half + rand.N(delay-half+1)
+}
+
+// Retryable marks err as a transient failure, so the download is tried again (up to --tries).
+// Fetchers registered with RegisterFetcher use it for errors such as dropped connections.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err}
+}
+
+// sleepContext waits for d, returning early with ctx's error if it is cancelled first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,80 @@
+package downloadutils
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// scheduleWindow is a daily time range with its own rate limit
+type scheduleWindow struct {
+	start, end time.Duration // Since midnight; a window ending before it starts runs past midnight
+	rate       int64         // bytes per second, 0 means no limit
+}
+
+// contains reports whether the time of day falls in the window
+func (w scheduleWindow) contains(day time.Duration) bool {
+	switch {
+	case w.start == w.end:
+		return true
+	case w.start < w.end:
+		return day >= w.start && day < w.end
+	}
+	return day >= w.start || day < w.end
+}
+
+// rateSchedule picks the rate limit by time of day (--rate-schedule)
+type rateSchedule struct {
+	windows []scheduleWindow
+	base    int64 // Rate outside every window (--rate-limit)
+}
+
+// parseRateSchedule parses windows such as "08:00-18:00=500k,18:00-08:00=0", where a rate of 0
+// lifts the limit. Outside the windows base applies; where windows overlap the first one wins.
+func parseRateSchedule(value string, base int64) (*rateSchedule, error) {
+	schedule := &rateSchedule{base: base}
+	for _, spec := range strings.Split(value, ",") {
+		spec = strings.TrimSpace(spec)
+		times, rate, ok := strings.Cut(spec, "=")
+		from, to, ok2 := strings.Cut(times, "-")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid rate schedule window %q (expected HH:MM-HH:MM=RATE)", spec)
+		}
+
+		start, err := parseTimeOfDay(from)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(to)
+		if err != nil {
+			return nil, err
+		}
+		bytesPerSecond, err := parseRateLimit(strings.TrimSpace(rate))
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate in rate schedule window %q: %v", spec, err)
+		}
+		schedule.windows = append(schedule.windows, scheduleWindow{start: start, end: end, rate: bytesPerSecond})
+	}
+	return schedule, nil
+}
+
+// parseTimeOfDay parses "HH:MM" into the time since midnight
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q (expected HH:MM)", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// rateAt returns the rate limit in effect at now, in local time
+func (s *rateSchedule) rateAt(now time.Time) int64 {
+	day := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute +
+		time.Duration(now.Second())*time.Second
+	for _, w := range s.windows {
+		if w.contains(day) {
+			return w.rate
+		}
+	}
+	return s.base
+}
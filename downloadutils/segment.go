@@ -0,0 +1,237 @@
+package downloadutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// segment is a byte range of a file fetched by its own goroutine
+type segment struct {
+	start int64 // First byte of the range
+	end   int64 // Last byte of the range (inclusive)
+	done  int64 // Bytes of the range already written
+}
+
+// remaining returns how many bytes of the segment are still missing
+func (s *segment) remaining() int64 {
+	return s.end - s.start + 1 - s.done
+}
+
+// contiguousBytes returns how many bytes from the start of the file are complete,
+// which is all a plain resume can rely on after a segmented download fails
+func contiguousBytes(segments []*segment) int64 {
+	var n int64
+	for _, seg := range segments {
+		n += seg.done
+		if seg.remaining() > 0 {
+			break
+		}
+	}
+	return n
+}
+
+// segmentWriter writes a segment's bytes at their place in the file and records its progress
+type segmentWriter struct {
+	file *os.File
+	seg  *segment
+}
+
+func (w *segmentWriter) Write(b []byte) (int, error) {
+	n, err := w.file.WriteAt(b, w.seg.start+w.seg.done)
+	w.seg.done += int64(n)
+	return n, err
+}
+
+// probeRanges asks the server whether it serves byte ranges.
+// The returned HEAD response carries the file size and headers.
+func (t *transfer) probeRanges() (*http.Response, bool) {
+	req, err := NewRequest(http.MethodHead, t.url, nil, t.opts)
+	if err != nil {
+		return nil, false
+	}
+	req = req.WithContext(t.ctx)
+	if t.conditional() {
+		AddConditionalHeaders(req, t.outputPath)
+	}
+
+	resp, err := t.session.Do(req)
+	if err != nil {
+		return nil, false
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return resp, false
+	}
+
+	if resp.StatusCode != http.StatusOK || resp.ContentLength <= 0 {
+		return nil, false
+	}
+	if !strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes") {
+		return nil, false
+	}
+	return resp, true
+}
+
+// splitSegments splits size bytes into n contiguous ranges of (nearly) equal length
+func splitSegments(size int64, n int) []*segment {
+	if int64(n) > size {
+		n = int(size)
+	}
+
+	segments := make([]*segment, 0, n)
+	chunk := size / int64(n)
+	for i := 0; i < n; i++ {
+		start := int64(i) * chunk
+		end := start + chunk - 1
+		if i == n-1 {
+			end = size - 1
+		}
+		segments = append(segments, &segment{start: start, end: end})
+	}
+	return segments
+}
+
+// fetchSegment downloads the missing part of a segment into the file
+func (t *transfer) fetchSegment(ctx context.Context, seg *segment, out *os.File, progress io.Writer) error {
+	from := seg.start + seg.done
+	req, err := NewRequest(http.MethodGet, t.url, nil, t.opts)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, seg.end))
+
+	resp, err := t.session.Do(req)
+	if err != nil {
+		return connectionError("failed to download segment", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return responseError(resp)
+	}
+	if start, _, err := parseContentRange(resp.Header.Get("Content-Range")); err != nil || start != from {
+		return &ProtocolError{fmt.Errorf("server returned wrong range (wanted %d-%d): %s", from, seg.end, resp.Header.Get("Content-Range"))}
+	}
+
+	// Never write past the end of the segment, even if the server sends more
+	var reader io.Reader = io.LimitReader(resp.Body, seg.remaining())
+	// The segments share the session's rate limits and quota, like any other downloads
+	reader = t.session.LimitReader(ctx, t.url, t.session.quota.reader(t.url, io.NopCloser(reader), from))
+	reader = io.TeeReader(reader, progress)
+
+	if _, err := io.Copy(&segmentWriter{file: out, seg: seg}, reader); err != nil {
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			return &IOError{fmt.Errorf("failed to save file: %v", err)}
+		}
+		return &retryableError{&NetworkError{fmt.Errorf("failed to download segment: %v", err)}}
+	}
+	if seg.remaining() > 0 {
+		return &retryableError{&NetworkError{fmt.Errorf("segment %d-%d ended early", seg.start, seg.end)}}
+	}
+	return nil
+}
+
+// attemptSegmented fetches the missing parts of every segment in parallel into a preallocated file
+func (t *transfer) attemptSegmented() error {
+	size := t.segments[len(t.segments)-1].end + 1
+	var have int64
+	for _, seg := range t.segments {
+		have += seg.done
+	}
+
+	if t.showProgress {
+		fmt.Fprintf(t.output, "content size: %d [~%.2fMB]\n", size, float64(size)/(1024*1024))
+		fmt.Fprintf(t.output, "downloading in %d segments\n", len(t.segments))
+	}
+
+	// Skip the file if the download limits don't allow it
+	if err := t.admit(size); err != nil {
+		return err
+	}
+
+	// Create parent directory if it doesn't exist
+	if err := os.MkdirAll(filepath.Dir(t.outputPath), 0o755); err != nil {
+		return &IOError{fmt.Errorf("failed to create directory: %v", err)}
+	}
+
+	if t.showProgress {
+		fmt.Fprintf(t.output, "File name: %s\n", filepath.Base(t.outputPath))
+		fmt.Fprintf(t.output, "saving file to: %s\n", t.outputPath)
+	}
+
+	// Preallocate the file on the first attempt, keep earlier bytes on retries
+	flags := os.O_CREATE | os.O_WRONLY
+	if have == 0 {
+		flags |= os.O_TRUNC
+	}
+	out, err := os.OpenFile(t.partPath(), flags, 0o644)
+	if err != nil {
+		return &IOError{fmt.Errorf("failed to create file: %v", err)}
+	}
+	defer out.Close()
+	if err := out.Truncate(size); err != nil {
+		return &IOError{fmt.Errorf("failed to allocate file: %v", err)}
+	}
+
+	// A single progress bar adds up the bytes of all segments
+	progress := t.newProgress(size, have)
+
+	// Cancelled by the stall detector when no segment makes progress
+	ctx, cancel := context.WithCancel(t.ctx)
+	defer cancel()
+	stalled := watchStall(progress, t.opts.StallTimeout, cancel)
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(t.segments))
+	for i, seg := range t.segments {
+		if seg.remaining() == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, seg *segment) {
+			defer wg.Done()
+			errs[i] = t.fetchSegment(ctx, seg, out, progress)
+		}(i, seg)
+	}
+	wg.Wait()
+
+	t.size = 0
+	for _, seg := range t.segments {
+		t.size += seg.done
+	}
+
+	progress.Stop()
+
+	err = errors.Join(errs...)
+	if stalled() && err != nil {
+		return stallError(t.opts.StallTimeout)
+	}
+	if err != nil {
+		// Retry if any segment failed transiently, the finished ones are kept
+		for _, segErr := range errs {
+			if segErr != nil && isRetryable(segErr, t.opts.RetryOnHTTPError) {
+				return &retryableError{err}
+			}
+		}
+		return err
+	}
+
+	if t.showProgress {
+		fmt.Fprintf(t.output, "\nDownloaded [%s]\n", t.url)
+		endTime := time.Now().Format("2006-01-02 15:04:05")
+		fmt.Fprintf(t.output, "finished at %s\n", endTime)
+	}
+
+	return nil
+}
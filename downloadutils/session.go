@@ -0,0 +1,124 @@
+package downloadutils
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"wget/models"
+)
+
+// Session holds the state shared by every request of a run, such as the HTTP client, its cookies and credentials.
+// Create one per run with NewSession and Close it when done so cookies get saved.
+type Session struct {
+	opts   *models.Options
+	client *http.Client
+	jar    *CookieJar
+	auth   *authTransport
+	limits *rateLimits
+	quota  *quota
+
+	// Used directly by protocols other than HTTP
+	transport *http.Transport
+	dialer    *dialer
+}
+
+// NewSession creates a Session for the given options, loading cookies if asked to
+func NewSession(opts *models.Options) (*Session, error) {
+	if opts == nil {
+		opts = models.NewOptions()
+	}
+
+	jar, err := NewCookieJar()
+	if err != nil {
+		return nil, err
+	}
+	if opts.LoadCookies != "" {
+		if err := jar.Load(opts.LoadCookies); err != nil {
+			return nil, err
+		}
+	}
+
+	limits, err := newRateLimits(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := newQuota(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	d := newDialer(opts)
+	transport, err := newTransport(opts, d)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := newAuthTransport(transport, opts)
+	return &Session{
+		opts:   opts,
+		client: &http.Client{Jar: jar, Transport: auth},
+		jar:    jar,
+		auth:   auth,
+		limits: limits,
+		quota:  q,
+
+		transport: transport,
+		dialer:    d,
+	}, nil
+}
+
+// AuthorizeHost lets the --user/--password and bearer credentials be sent to the host of rawURL.
+// Hosts reached only through redirects never see them.
+func (s *Session) AuthorizeHost(rawURL string) {
+	s.auth.authorizeHost(rawURL)
+}
+
+// Do sends a request with the session's client. Errors are a TLSError, an AuthError or a NetworkError.
+func (s *Session) Do(req *http.Request) (*http.Response, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, typeConnectionError(err, err)
+	}
+	return resp, nil
+}
+
+// LimitReader paces body, a download of rawURL, with the session's rate limits. Every
+// download of the session shares the --rate-limit; the --host-rate-limit of rawURL's host
+// applies on top of it.
+func (s *Session) LimitReader(ctx context.Context, rawURL string, body io.ReadCloser) io.ReadCloser {
+	limiters := s.limits.limiters(rawURL)
+	if len(limiters) == 0 {
+		return body
+	}
+	return newLimitedReader(ctx, body, limiters...)
+}
+
+// CheckLimits returns a *LimitError if --quota or --max-files leave no room for another
+// download, recording rawURL as skipped. Nothing is counted.
+func (s *Session) CheckLimits(rawURL string) error {
+	return s.quota.check(rawURL)
+}
+
+// Admit checks a download of rawURL against --max-files, --quota and --max-filesize (size is
+// the size of the whole file, -1 if unknown) and counts it as one of the files. The returned
+// body counts its bytes against the quota. A skipped download returns a *LimitError.
+func (s *Session) Admit(rawURL string, size int64, body io.ReadCloser) (io.ReadCloser, error) {
+	if err := s.quota.admit(rawURL, size); err != nil {
+		return nil, err
+	}
+	return s.quota.reader(rawURL, body, 0), nil
+}
+
+// ReportSkipped prints the downloads skipped so far because of the download limits, if any
+func (s *Session) ReportSkipped(w io.Writer) {
+	s.quota.report(w)
+}
+
+// Close saves the session's cookies if asked to
+func (s *Session) Close() error {
+	if s.opts.SaveCookies != "" {
+		return s.jar.Save(s.opts.SaveCookies, s.opts.KeepSessionCookies)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package downloadutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"wget/models"
+)
+
+// StdoutPath as an output path (-O -) sends the download to stdout
+const StdoutPath = "-"
+
+// sinkWriter remembers whether writing to the sink failed, to tell it apart from a dropped connection
+type sinkWriter struct {
+	w   io.Writer
+	err error
+}
+
+// Write implements io.Writer
+func (s *sinkWriter) Write(b []byte) (int, error) {
+	n, err := s.w.Write(b)
+	if err != nil {
+		s.err = err
+	}
+	return n, err
+}
+
+// attemptStream makes a single try at sending the body to the sink. Bytes already sent by
+// earlier attempts can't be taken back, so a retry resumes right after them.
+func (t *transfer) attemptStream() error {
+	ctx, cancel := context.WithCancel(t.ctx)
+	defer cancel()
+
+	sent := t.size
+	s, err := t.open(ctx, sent)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return nil
+	}
+	defer s.Body.Close()
+
+	if t.showProgress {
+		fmt.Fprintf(t.output, "sending request, awaiting response... status %s\n", s.Metadata.Status)
+	}
+
+	// The server ignored our Range request, skip what the sink already has
+	if s.Offset < sent {
+		if _, err := io.CopyN(io.Discard, s.Body, sent-s.Offset); err != nil {
+			return &retryableError{&NetworkError{fmt.Errorf("failed to download file: %v", err)}}
+		}
+	}
+
+	size := s.Size
+	if t.showProgress {
+		fmt.Fprintf(t.output, "content size: %d [~%.2fMB]\n", size, float64(size)/(1024*1024))
+	}
+
+	if err := t.admit(size); err != nil {
+		return err
+	}
+	var reader io.Reader = t.session.LimitReader(ctx, t.url, t.session.quota.reader(t.url, s.Body, sent))
+
+	progress := t.newProgress(size, sent)
+	reader = io.TeeReader(reader, progress)
+	stalled := watchStall(progress, t.opts.StallTimeout, cancel)
+
+	out := &sinkWriter{w: t.sink}
+	var w io.Writer = out
+	if t.sinkHash != nil {
+		w = io.MultiWriter(out, t.sinkHash)
+	}
+
+	written, err := io.Copy(w, reader)
+	t.size += written
+	if stalled() && err != nil {
+		return stallError(t.opts.StallTimeout)
+	}
+	if out.err != nil {
+		// A closed pipe or a full disk won't get better by asking again
+		return &IOError{fmt.Errorf("failed to write output: %v", out.err)}
+	}
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return err
+	}
+	if err != nil {
+		return &retryableError{&NetworkError{fmt.Errorf("failed to download file: %v", err)}}
+	}
+
+	if t.showProgress {
+		progress.Stop()
+		fmt.Fprintf(t.output, "\nDownloaded [%s]\n", t.url)
+		fmt.Fprintf(t.output, "finished at %s\n", time.Now().Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+// DownloadConcatenated downloads the URLs one after another into a single file, like
+// wget -O FILE URL1 URL2. With StdoutPath the bodies go to stdout and the messages to stderr.
+// A file only gets its name once every URL was downloaded.
+func DownloadConcatenated(ctx context.Context, urls []string, outputPath string, opts *models.Options) error {
+	output := io.Writer(os.Stdout)
+	if outputPath == StdoutPath {
+		output = os.Stderr
+	}
+	client, err := NewClient(WithOptions(opts), WithOutput(output))
+	if err != nil {
+		return err
+	}
+
+	var sink io.Writer = os.Stdout
+	var part *os.File
+	if outputPath != StdoutPath {
+		part, err = os.Create(outputPath + ".part")
+		if err != nil {
+			return &IOError{fmt.Errorf("failed to create file: %v", err)}
+		}
+		defer part.Close()
+		sink = part
+	}
+
+	var errs []error
+	for _, url := range urls {
+		if ctx.Err() != nil {
+			break
+		}
+		req := &Request{URL: url, OutputPath: outputPath, Writer: sink}
+		if len(urls) == 1 {
+			req.Checksum = client.opts.Checksum
+		}
+		var limitErr *LimitError
+		if _, err := client.Do(ctx, req); errors.As(err, &limitErr) {
+			// Left out of the output, the report below lists it
+			continue
+		} else if err != nil {
+			fmt.Fprintf(output, "Error downloading %s: %v\n", url, err)
+			errs = append(errs, err)
+		}
+	}
+
+	client.Session().ReportSkipped(output)
+
+	// Save cookies for the next run
+	if err := client.Close(); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return JoinErrors(fmt.Sprintf("%d of %d downloads failed", len(errs), len(urls)), errs)
+	}
+	if part != nil {
+		if err := part.Close(); err != nil {
+			return &IOError{fmt.Errorf("failed to save file: %v", err)}
+		}
+		if err := os.Rename(part.Name(), outputPath); err != nil {
+			return &IOError{fmt.Errorf("failed to rename %s: %v", part.Name(), err)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package downloadutils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+	"wget/models"
+)
+
+// defaultConnectTimeout matches net/http's default dialer
+const defaultConnectTimeout = 30 * time.Second
+
+// dialer opens connections with the DNS, connect and read timeouts of a session
+type dialer struct {
+	dnsTimeout     time.Duration
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+}
+
+// newDialer creates a dialer from the options, where --timeout fills in the timeouts not given
+func newDialer(opts *models.Options) *dialer {
+	d := &dialer{
+		dnsTimeout:     opts.DNSTimeout,
+		connectTimeout: opts.ConnectTimeout,
+		readTimeout:    opts.ReadTimeout,
+	}
+	if d.dnsTimeout == 0 {
+		d.dnsTimeout = opts.Timeout
+	}
+	if d.connectTimeout == 0 {
+		d.connectTimeout = opts.Timeout
+	}
+	if d.readTimeout == 0 {
+		d.readTimeout = opts.Timeout
+	}
+	if d.connectTimeout == 0 {
+		d.connectTimeout = defaultConnectTimeout
+	}
+	return d
+}
+
+// Dial implements proxy.Dialer
+func (d *dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext resolves the host within the DNS timeout, then tries its addresses within the connect timeout
+func (d *dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := []string{addr}
+	if d.dnsTimeout > 0 && net.ParseIP(host) == nil {
+		lookupCtx, cancel := context.WithTimeout(ctx, d.dnsTimeout)
+		defer cancel()
+		ips, err := net.DefaultResolver.LookupIPAddr(lookupCtx, host)
+		if err != nil {
+			return nil, err
+		}
+		addrs = addrs[:0]
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+	}
+
+	nd := &net.Dialer{Timeout: d.connectTimeout, KeepAlive: 30 * time.Second}
+	var conn net.Conn
+	for _, a := range addrs {
+		if conn, err = nd.DialContext(ctx, network, a); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if d.readTimeout > 0 {
+		return &deadlineConn{Conn: conn, timeout: d.readTimeout}, nil
+	}
+	return conn, nil
+}
+
+// deadlineConn fails a read that gets no data within the read timeout
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// Read implements io.Reader
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// watchStall cancels a download once its progress sees no bytes for timeout.
+// The returned stop function ends the watch and reports whether the download stalled.
+func watchStall(progress *Progress, timeout time.Duration, cancel context.CancelFunc) func() bool {
+	if timeout <= 0 {
+		return func() bool { return false }
+	}
+
+	var stalled atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(timeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if progress.Idle() >= timeout {
+					stalled.Store(true)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		return stalled.Load()
+	}
+}
+
+// stallError reports a download that stopped receiving data
+func stallError(timeout time.Duration) error {
+	return &retryableError{&NetworkError{fmt.Errorf("download stalled: no data received for %s", timeout)}}
+}
@@ -0,0 +1,188 @@
+package downloadutils
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// etagCompactSize is how large an ETag file may grow before it is compacted
+const etagCompactSize = 64 << 10
+
+var (
+	etagMu        sync.Mutex
+	etagCache     = make(map[string]map[string]string) // ETag files read by this run, by file
+	etagCompacted = make(map[string]int64)             // Size of each ETag file after its last compaction
+)
+
+// ErrNotModified reports that the server copy is no newer than the local one (HTTP 304)
+var ErrNotModified = errors.New("server file no newer than local file")
+
+// etagFile returns the file that remembers the ETags of the downloads in dir. Each directory
+// has its own, named after a hash of its path, in the user's cache directory so it never
+// ends up among the downloads.
+func etagFile(dir string) (string, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(dir))
+	return filepath.Join(cache, "wget", "etags", hex.EncodeToString(sum[:16])), nil
+}
+
+// readETags reads an ETag file into a map by file name. Entries are only ever appended,
+// so a later line for a name replaces the earlier ones and an empty ETag forgets it.
+func readETags(filename string) map[string]string {
+	etags := make(map[string]string)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return etags
+	}
+	defer file.Close()
+
+	// An ETag never contains a tab, the name after it might
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		etag, name, ok := strings.Cut(scanner.Text(), "\t")
+		switch {
+		case !ok:
+		case etag == "":
+			delete(etags, name)
+		default:
+			etags[name] = etag
+		}
+	}
+	return etags
+}
+
+// cachedETags returns the ETags of a file, reading it only once per run. The caller holds etagMu.
+func cachedETags(filename string) map[string]string {
+	etags, ok := etagCache[filename]
+	if !ok {
+		etags = readETags(filename)
+		etagCache[filename] = etags
+	}
+	return etags
+}
+
+// LoadETag returns the ETag recorded for a downloaded file, if any
+func LoadETag(path string) string {
+	filename, err := etagFile(filepath.Dir(path))
+	if err != nil {
+		return ""
+	}
+
+	etagMu.Lock()
+	defer etagMu.Unlock()
+	return cachedETags(filename)[filepath.Base(path)]
+}
+
+// SaveETag records the ETag of a downloaded file for later conditional requests, or
+// forgets it when etag is empty. Entries are appended, so concurrent runs keep each other's.
+func SaveETag(path, etag string) error {
+	filename, err := etagFile(filepath.Dir(path))
+	if err != nil {
+		// Nowhere to keep it, the modification time still works
+		return nil
+	}
+	name := filepath.Base(path)
+	if strings.ContainsAny(name, "\n\r") || strings.ContainsAny(etag, "\t\n\r") {
+		return nil
+	}
+
+	etagMu.Lock()
+	defer etagMu.Unlock()
+
+	etags := cachedETags(filename)
+	if etags[name] == etag {
+		return nil
+	}
+	if etag == "" {
+		delete(etags, name)
+	} else {
+		etags[name] = etag
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return &IOError{fmt.Errorf("failed to create ETag directory: %v", err)}
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return &IOError{fmt.Errorf("failed to open ETag file: %v", err)}
+	}
+	_, err = fmt.Fprintf(file, "%s\t%s\n", etag, name)
+	info, statErr := file.Stat()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return &IOError{fmt.Errorf("failed to write ETag file: %v", err)}
+	}
+
+	// Rewrite the file once replaced entries make up most of it
+	if statErr == nil && info.Size() > max(etagCompactSize, 2*etagCompacted[filename]) {
+		return compactETags(filename, filepath.Dir(path))
+	}
+	return nil
+}
+
+// compactETags rewrites an ETag file with one line per file of dir that still exists.
+// The caller holds etagMu.
+func compactETags(filename, dir string) error {
+	// Read it again for what other runs appended
+	etags := readETags(filename)
+	var b strings.Builder
+	for name, etag := range etags {
+		if !fileExists(filepath.Join(dir, name)) {
+			delete(etags, name)
+			continue
+		}
+		fmt.Fprintf(&b, "%s\t%s\n", etag, name)
+	}
+	if err := WriteFileAtomic(filename, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	etagCache[filename] = etags
+	etagCompacted[filename] = int64(b.Len())
+	return nil
+}
+
+// AddConditionalHeaders makes req conditional on the local copy at path having changed,
+// using its modification time (If-Modified-Since) and recorded ETag (If-None-Match)
+func AddConditionalHeaders(req *http.Request, path string) {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+
+	req.Header.Set("If-Modified-Since", info.ModTime().UTC().Format(http.TimeFormat))
+	if etag := LoadETag(path); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+}
+
+// ApplyTimestamps sets the local file's modification time from the Last-Modified header
+// and records its ETag, so the next timestamping run can ask whether it changed
+func ApplyTimestamps(path string, header http.Header) error {
+	if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		if err := os.Chtimes(path, time.Now(), lastModified); err != nil {
+			return &IOError{fmt.Errorf("failed to set file time: %v", err)}
+		}
+	}
+	// The ETag only saves a transfer next time, losing it isn't worth failing the download
+	SaveETag(path, header.Get("ETag"))
+	return nil
+}
@@ -0,0 +1,145 @@
+package downloadutils
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"wget/models"
+)
+
+// tlsVersions maps --secure-protocol values to TLS versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig builds the TLS configuration for a session from the certificate options
+func newTLSConfig(opts *models.Options) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: opts.NoCheckCertificate}
+
+	if opts.MinTLSVersion != "" && !strings.EqualFold(opts.MinTLSVersion, "auto") {
+		// Also accepts wget's spelling, e.g., TLSv1_2
+		name := strings.ReplaceAll(strings.TrimPrefix(strings.ToUpper(opts.MinTLSVersion), "TLSV"), "_", ".")
+		version, ok := tlsVersions[name]
+		if !ok {
+			return nil, &ParseError{fmt.Errorf("unsupported TLS version: %s", opts.MinTLSVersion)}
+		}
+		config.MinVersion = version
+	}
+
+	// Extra certificate authorities are trusted on top of the system ones
+	if opts.CACertificate != "" || opts.CADirectory != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if opts.CACertificate != "" {
+			if err := addCertificates(pool, opts.CACertificate); err != nil {
+				return nil, err
+			}
+		}
+		if opts.CADirectory != "" {
+			entries, err := os.ReadDir(opts.CADirectory)
+			if err != nil {
+				return nil, &IOError{fmt.Errorf("failed to read CA directory: %v", err)}
+			}
+			for _, entry := range entries {
+				if entry.IsDir() {
+					continue
+				}
+				// Files that aren't certificates (e.g., hash symlinks to missing files) are ignored
+				_ = addCertificates(pool, filepath.Join(opts.CADirectory, entry.Name()))
+			}
+		}
+		config.RootCAs = pool
+	}
+
+	// Client certificate for mutual TLS; the key defaults to the certificate file
+	if opts.Certificate != "" {
+		keyFile := opts.PrivateKey
+		if keyFile == "" {
+			keyFile = opts.Certificate
+		}
+		cert, err := tls.LoadX509KeyPair(opts.Certificate, keyFile)
+		if err != nil {
+			return nil, &IOError{fmt.Errorf("failed to load client certificate: %v", err)}
+		}
+		config.Certificates = []tls.Certificate{cert}
+	} else if opts.PrivateKey != "" {
+		return nil, &ParseError{fmt.Errorf("--private-key requires --certificate")}
+	}
+
+	if opts.PinnedPubKey != "" {
+		pins, err := parsePins(opts.PinnedPubKey)
+		if err != nil {
+			return nil, err
+		}
+		// Runs even with --no-check-certificate, so a pin still protects the connection
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return &TLSError{fmt.Errorf("no server certificate to check the pinned public key against")}
+			}
+			sum := sha256.Sum256(state.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			if !pins[sum] {
+				return &TLSError{fmt.Errorf("server public key of %s does not match the pinned public key", state.ServerName)}
+			}
+			return nil
+		}
+	}
+
+	return config, nil
+}
+
+// addCertificates adds the PEM certificates in file to pool
+func addCertificates(pool *x509.CertPool, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return &IOError{fmt.Errorf("failed to read CA certificate: %v", err)}
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return &ParseError{fmt.Errorf("no certificates found in %s", file)}
+	}
+	return nil
+}
+
+// parsePins parses --pinnedpubkey: "sha256//<base64>" hashes separated by ";", or a
+// PEM or DER file holding the public key
+func parsePins(value string) (map[[sha256.Size]byte]bool, error) {
+	pins := make(map[[sha256.Size]byte]bool)
+
+	if strings.HasPrefix(value, "sha256//") {
+		for _, pin := range strings.Split(value, ";") {
+			encoded, ok := strings.CutPrefix(strings.TrimSpace(pin), "sha256//")
+			if !ok {
+				return nil, &ParseError{fmt.Errorf("invalid pinned public key %q", pin)}
+			}
+			decoded, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil || len(decoded) != sha256.Size {
+				return nil, &ParseError{fmt.Errorf("invalid pinned public key %q", pin)}
+			}
+			pins[[sha256.Size]byte(decoded)] = true
+		}
+		return pins, nil
+	}
+
+	data, err := os.ReadFile(value)
+	if err != nil {
+		return nil, &IOError{fmt.Errorf("failed to read pinned public key: %v", err)}
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	if _, err := x509.ParsePKIXPublicKey(data); err != nil {
+		return nil, &ParseError{fmt.Errorf("invalid pinned public key in %s: %v", value, err)}
+	}
+	pins[sha256.Sum256(data)] = true
+	return pins, nil
+}
@@ -0,0 +1,25 @@
+package downloadutils
+
+import (
+	"net/http"
+	"wget/models"
+)
+
+// newTransport creates the HTTP transport shared by every request of a session
+func newTransport(opts *models.Options, d *dialer) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	tlsConfig, err := newTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	transport.DialContext = d.DialContext
+	transport.TLSHandshakeTimeout = d.connectTimeout
+
+	if err := configureProxy(transport, d, opts); err != nil {
+		return nil, err
+	}
+	return transport, nil
+}
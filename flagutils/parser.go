@@ -3,11 +3,50 @@ package flagutils
 import (
 	"flag"
 	"fmt"
+	"math"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 	"wget/models"
 )
 
+// stringList is a flag.Value collecting every occurrence of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// seconds is a flag.Value for a duration that, as in GNU wget, may be given as a bare
+// number of seconds (e.g., 10 or 0.5) as well as with a unit (e.g., 1m30s)
+type seconds time.Duration
+
+func (d *seconds) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *seconds) Set(value string) error {
+	if n, err := strconv.ParseFloat(value, 64); err == nil {
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		*d = seconds(n * float64(time.Second))
+		return nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", value)
+	}
+	*d = seconds(duration)
+	return nil
+}
+
 // ParseFlags parses command line arguments and returns Options
 func ParseFlags() (*models.Options, error) {
 	// Create a new FlagSet to avoid global state
@@ -19,8 +58,87 @@ func ParseFlags() (*models.Options, error) {
 	fs.StringVar(&opts.OutputFile, "O", "", "Write documents to FILE")
 	fs.StringVar(&opts.OutputPath, "P", "", "Save files to PATH")
 	fs.StringVar(&opts.RateLimit, "rate-limit", "", "Limit the download speed to rate (e.g., 100k or 1M)")
+	fs.StringVar(&opts.RateSchedule, "rate-schedule", "", "Limit the download speed by time of day (e.g., 08:00-18:00=500k,18:00-08:00=0)")
+	fs.Var((*stringList)(&opts.HostRateLimits), "host-rate-limit", "Limit the download speed from HOST=RATE (repeatable, e.g., example.com=100k)")
 	fs.StringVar(&opts.InputFile, "i", "", "Read URLs from file")
+
+	// Download limits
+	fs.StringVar(&opts.Quota, "Q", "", "Stop after downloading SIZE bytes in total (e.g., 100M)")
+	fs.StringVar(&opts.Quota, "quota", "", "Stop after downloading SIZE bytes in total (e.g., 100M)")
+	fs.StringVar(&opts.MaxFileSize, "max-filesize", "", "Skip files larger than SIZE (e.g., 10M)")
+	fs.IntVar(&opts.MaxFiles, "max-files", 0, "Download at most N files")
+
 	fs.BoolVar(&opts.Mirror, "mirror", false, "Mirror website")
+	fs.BoolVar(&opts.Continue, "c", false, "Resume getting a partially-downloaded file")
+	fs.BoolVar(&opts.Continue, "continue", false, "Resume getting a partially-downloaded file")
+
+	// Retry-related flags
+	fs.IntVar(&opts.Tries, "t", 1, "Set number of tries to NUMBER")
+	fs.IntVar(&opts.Tries, "tries", 1, "Set number of tries to NUMBER")
+	opts.WaitRetry = 10 * time.Second
+	fs.Var((*seconds)(&opts.WaitRetry), "waitretry", "Wait at most DURATION between retries (e.g., 10 or 10s)")
+	var retryOnHTTPError string
+	fs.StringVar(&retryOnHTTPError, "retry-on-http-error", "", "Also retry on these HTTP status codes (comma-separated list)")
+
+	fs.IntVar(&opts.Segments, "segments", 1, "Download each file in N parallel byte ranges")
+
+	// Checksum-related flags
+	fs.StringVar(&opts.Checksum, "checksum", "", "Verify the download against ALGO:HEX (e.g., sha256:ab12...)")
+	fs.StringVar(&opts.ChecksumManifest, "checksum-manifest", "", "Verify downloads against (or write) a manifest such as SHA256SUMS")
+
+	// File naming flags
+	fs.BoolVar(&opts.ContentDisposition, "content-disposition", false, "Honor the Content-Disposition header when choosing local file names")
+	fs.BoolVar(&opts.TrustServerNames, "trust-server-names", false, "Use the name from the last redirect URL as the local file name")
+	fs.BoolVar(&opts.NoClobber, "nc", false, "Skip downloads that would overwrite existing files")
+	fs.BoolVar(&opts.NoClobber, "no-clobber", false, "Skip downloads that would overwrite existing files")
+	fs.IntVar(&opts.Backups, "backups", 0, "Keep up to N numbered backups of files that get replaced")
+	fs.BoolVar(&opts.Timestamping, "N", false, "Don't re-retrieve files unless newer than local")
+	fs.BoolVar(&opts.Timestamping, "timestamping", false, "Don't re-retrieve files unless newer than local")
+
+	// Request-related flags
+	fs.Var((*stringList)(&opts.Headers), "header", "Insert STRING among the headers sent (repeatable, e.g., \"Authorization: Bearer x\")")
+	fs.StringVar(&opts.UserAgent, "U", "", "Identify as AGENT instead of the default")
+	fs.StringVar(&opts.UserAgent, "user-agent", "", "Identify as AGENT instead of the default")
+	fs.StringVar(&opts.Method, "method", "", "Use METHOD for the request (e.g., POST)")
+	fs.StringVar(&opts.PostData, "post-data", "", "Send STRING as the request body (implies POST)")
+	fs.StringVar(&opts.BodyFile, "body-file", "", "Send the contents of FILE as the request body (implies POST)")
+
+	// Cookie-related flags
+	fs.StringVar(&opts.LoadCookies, "load-cookies", "", "Load cookies from FILE (Netscape cookies.txt format)")
+	fs.StringVar(&opts.SaveCookies, "save-cookies", "", "Save cookies to FILE when done")
+	fs.BoolVar(&opts.KeepSessionCookies, "keep-session-cookies", false, "Also save session cookies")
+
+	// Authentication-related flags
+	fs.StringVar(&opts.User, "user", "", "Authenticate as USER (Basic or Digest)")
+	fs.StringVar(&opts.Password, "password", "", "Authenticate with PASS")
+	fs.BoolVar(&opts.AskPassword, "ask-password", false, "Prompt for the password")
+	fs.StringVar(&opts.BearerToken, "bearer-token", "", "Send TOKEN as a bearer token")
+	fs.BoolVar(&opts.NoNetrc, "no-netrc", false, "Don't look up credentials in ~/.netrc")
+
+	// Proxy-related flags
+	fs.StringVar(&opts.Proxy, "proxy", "", "Use PROXY (http://host:port or socks5://host:port) instead of http_proxy/https_proxy")
+	fs.BoolVar(&opts.NoProxy, "no-proxy", false, "Don't use proxies, even if set in the environment")
+	fs.StringVar(&opts.ProxyUser, "proxy-user", "", "Authenticate to the proxy as USER")
+	fs.StringVar(&opts.ProxyPassword, "proxy-password", "", "Authenticate to the proxy with PASS")
+
+	// Timeout-related flags
+	fs.Var((*seconds)(&opts.Timeout), "T", "Set the DNS, connect and read timeouts to DURATION")
+	fs.Var((*seconds)(&opts.Timeout), "timeout", "Set the DNS, connect and read timeouts to DURATION")
+	fs.Var((*seconds)(&opts.DNSTimeout), "dns-timeout", "Give up resolving host names after DURATION")
+	fs.Var((*seconds)(&opts.ConnectTimeout), "connect-timeout", "Give up connecting after DURATION")
+	fs.Var((*seconds)(&opts.ReadTimeout), "read-timeout", "Give up when no data arrives for DURATION")
+	fs.Var((*seconds)(&opts.StallTimeout), "stall-timeout", "Abort (and retry) downloads that make no progress for DURATION")
+
+	fs.BoolVar(&opts.NoPassiveFTP, "no-passive-ftp", false, "Use active FTP transfers")
+
+	// TLS-related flags
+	fs.StringVar(&opts.CACertificate, "ca-certificate", "", "Also trust the certificate authorities in FILE")
+	fs.StringVar(&opts.CADirectory, "ca-directory", "", "Also trust the certificate authorities in DIR")
+	fs.StringVar(&opts.Certificate, "certificate", "", "Client certificate FILE for mutual TLS")
+	fs.StringVar(&opts.PrivateKey, "private-key", "", "Private key FILE of the client certificate")
+	fs.BoolVar(&opts.NoCheckCertificate, "no-check-certificate", false, "Don't validate the server's certificate")
+	fs.StringVar(&opts.MinTLSVersion, "secure-protocol", "", "Oldest TLS version to accept (1.0, 1.1, 1.2, 1.3 or TLSv1_2 style)")
+	fs.StringVar(&opts.PinnedPubKey, "pinnedpubkey", "", "Require the server's public key to match sha256//HASH[;sha256//HASH] or a key FILE")
 
 	// Mirror-related flags
 	var rejectListShort, rejectListLong string
@@ -80,5 +198,42 @@ func ParseFlags() (*models.Options, error) {
 	}
 	opts.ExcludePaths = excludePaths
 
+	// Validate custom headers
+	for _, header := range opts.Headers {
+		if name, _, ok := strings.Cut(header, ":"); !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header %q, expected NAME: VALUE", header)
+		}
+	}
+	if opts.PostData != "" && opts.BodyFile != "" {
+		return nil, fmt.Errorf("--post-data and --body-file cannot be used together")
+	}
+
+	// Process the extra HTTP status codes to retry
+	if retryOnHTTPError != "" {
+		for _, code := range strings.Split(retryOnHTTPError, ",") {
+			status, err := strconv.Atoi(strings.TrimSpace(code))
+			if err != nil || status < 100 || status > 599 {
+				return nil, fmt.Errorf("invalid HTTP status code in --retry-on-http-error: %q", code)
+			}
+			opts.RetryOnHTTPError = append(opts.RetryOnHTTPError, status)
+		}
+	}
+
+	if opts.Proxy != "" && opts.NoProxy {
+		return nil, fmt.Errorf("--proxy and --no-proxy cannot be used together")
+	}
+
+	// Prompt for the password once everything else is known to be valid
+	if opts.AskPassword {
+		if opts.Password != "" {
+			return nil, fmt.Errorf("--password and --ask-password cannot be used together")
+		}
+		password, err := readPassword(fmt.Sprintf("Password for user '%s': ", opts.User))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read password: %v", err)
+		}
+		opts.Password = password
+	}
+
 	return opts, nil
 }
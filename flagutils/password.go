@@ -0,0 +1,41 @@
+package flagutils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// readPassword prompts on stderr and reads a line from the terminal with echo turned off.
+// When there is no terminal it reads the password from stdin instead.
+func readPassword(prompt string) (string, error) {
+	input := os.Stdin
+	if tty, err := os.Open("/dev/tty"); err == nil {
+		defer tty.Close()
+		input = tty
+
+		// Turn echo off while the password is typed (best effort, stty may be missing)
+		if err := stty(tty, "-echo"); err == nil {
+			defer func() {
+				stty(tty, "echo")
+				fmt.Fprintln(os.Stderr)
+			}()
+		}
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(input).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// stty changes the settings of the terminal
+func stty(tty *os.File, args ...string) error {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = tty
+	return cmd.Run()
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
-	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 	"wget/downloadutils"
 	"wget/flagutils"
@@ -25,26 +28,55 @@ func expandPath(path string) (string, error) {
 	return path, nil
 }
 
+// exitInterrupted is the exit status after Ctrl-C, the same a shell reports for SIGINT
+const exitInterrupted = 130
+
+// exitIfInterrupted prints a note about the unfinished work and exits if ctx was cancelled by a signal
+func exitIfInterrupted(ctx context.Context, format string, args ...any) {
+	if ctx.Err() == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\nInterrupted: "+format+"\n", args...)
+	os.Exit(exitInterrupted)
+}
+
+// partialFileNote describes what an interrupted download of outputPath left behind
+func partialFileNote(outputPath string) string {
+	if _, err := os.Stat(outputPath + ".part"); err == nil {
+		return fmt.Sprintf("partial file kept in %s.part, run again with -c to resume", outputPath)
+	}
+	return "nothing was saved"
+}
+
 func main() {
 	// Parse command line flags
 	options, err := flagutils.ParseFlags()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		os.Exit(downloadutils.ExitParse)
 	}
 
+	// Ctrl-C cancels the transfers in flight, which keep their .part files for a later -c
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// Let a second Ctrl-C kill us right away
+		stop()
+	}()
+
 	// Handle background download (-B flag)
 	if options.Background {
 		if len(options.URLs) != 1 {
 			fmt.Fprintf(os.Stderr, "Error: -B flag requires exactly one URL\n")
-			os.Exit(1)
+			os.Exit(downloadutils.ExitParse)
 		}
 
 		// Create log file
 		logFile, err := os.OpenFile("wget-log", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error creating log file: %v\n", err)
-			os.Exit(1)
+			os.Exit(downloadutils.ExitIO)
 		}
 		defer logFile.Close()
 
@@ -53,9 +85,10 @@ func main() {
 
 		// Get filename from URL
 		url := options.URLs[0]
-		filename := filepath.Base(url)
-		if filename == "" || filename == "." || filename == "/" {
-			filename = "index.html"
+		filename, err := downloadutils.FilenameFromURL(url)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(downloadutils.ExitCode(err))
 		}
 
 		// Create a WaitGroup to ensure the download starts
@@ -65,7 +98,7 @@ func main() {
 		// Start download in background
 		go func() {
 			defer wg.Done()
-			err := downloadutils.DownloadFileBackground(url, filename, options.RateLimit, logFile)
+			err := downloadutils.DownloadFileBackground(ctx, url, filename, options, logFile)
 			if err != nil {
 				fmt.Fprintf(logFile, "Error: %v\n", err)
 			}
@@ -83,7 +116,7 @@ func main() {
 		file, err := os.Open(options.InputFile)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error opening input file: %v\n", err)
-			os.Exit(1)
+			os.Exit(downloadutils.ExitIO)
 		}
 		defer file.Close()
 
@@ -99,46 +132,57 @@ func main() {
 		}
 		if err := os.MkdirAll(downloadsDir, 0755); err != nil {
 			fmt.Fprintf(os.Stderr, "Error creating downloads directory: %v\n", err)
-			os.Exit(1)
+			os.Exit(downloadutils.ExitIO)
 		}
 
 		// Create concurrent downloader
-		concurrentDownloader := downloadutils.NewConcurrentDownloader(5, downloadsDir, options.RateLimit)
+		concurrentDownloader := downloadutils.NewConcurrentDownloader(5, downloadsDir, options)
 
-		// Read URLs line by line
+		// Read URLs line by line, each optionally followed by its checksum
 		var urls []string
+		checksums := make(map[string]string)
 		scanner := bufio.NewScanner(file)
 		for scanner.Scan() {
-			url := strings.TrimSpace(scanner.Text())
-			if url != "" && !strings.HasPrefix(url, "#") {
-				urls = append(urls, url)
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			fields := strings.Fields(line)
+			urls = append(urls, fields[0])
+			if len(fields) > 1 {
+				checksums[fields[0]] = fields[1]
 			}
 		}
 
 		if err := scanner.Err(); err != nil {
 			fmt.Fprintf(os.Stderr, "Error reading input file: %v\n", err)
-			os.Exit(1)
+			os.Exit(downloadutils.ExitIO)
 		}
 
+		concurrentDownloader.SetChecksums(checksums)
+
 		// Download all URLs concurrently
-		results := concurrentDownloader.DownloadURLs(urls)
+		results := concurrentDownloader.DownloadURLs(ctx, urls)
 
 		// Print summary
 		successCount := 0
+		var errs []error
 		for _, result := range results {
 			if result.Success {
 				successCount++
 			}
+			errs = append(errs, result.Error)
 		}
+		exitIfInterrupted(ctx, "%d/%d files downloaded successfully, run again with -c to resume the rest", successCount, len(urls))
 		fmt.Printf("\nDownload summary: %d/%d files downloaded successfully\n", successCount, len(urls))
-		return
+		os.Exit(downloadutils.ExitStatus(errs...))
 	}
 
 	// Handle mirror mode
 	if options.Mirror {
 		if len(options.URLs) != 1 {
 			fmt.Fprintf(os.Stderr, "Error: mirror mode requires exactly one URL\n")
-			os.Exit(1)
+			os.Exit(downloadutils.ExitParse)
 		}
 
 		// Set output directory
@@ -158,20 +202,42 @@ func main() {
 			fmt.Fprintf(os.Stderr, "Error: Failed to create mirror options\n")
 			os.Exit(1)
 		}
+		mirrorOpts.Options = options
 
 		// Start mirroring
 		fmt.Printf("Starting mirror of %s\n", options.URLs[0])
 		fmt.Printf("Output directory: %s\n", outputDir)
 
-		if err := mirrorOpts.Mirror(); err != nil {
+		if err := mirrorOpts.Mirror(ctx); err != nil {
+			exitIfInterrupted(ctx, "files mirrored so far are kept in %s", outputDir)
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+			os.Exit(downloadutils.ExitCode(err))
 		}
 
 		fmt.Printf("\nMirroring complete. You can use a tool like 'live-server' to view the mirrored content.\n")
 		return
 	}
 
+	// Handle -O with several URLs (or -O - for stdout): all bodies go into the one output
+	if options.OutputFile == downloadutils.StdoutPath || (options.OutputFile != "" && len(options.URLs) > 1) {
+		outputPath := options.OutputFile
+		if outputPath != downloadutils.StdoutPath {
+			outputDir, err := expandPath(options.OutputPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			outputPath = filepath.Clean(filepath.Join(outputDir, filepath.Base(options.OutputFile)))
+		}
+
+		if err := downloadutils.DownloadConcatenated(ctx, options.URLs, outputPath, options); err != nil {
+			exitIfInterrupted(ctx, "the output is incomplete")
+			fmt.Fprintf(os.Stderr, "Error downloading file: %v\n", err)
+			os.Exit(downloadutils.ExitCode(err))
+		}
+		return
+	}
+
 	// Handle direct file download
 	var outputPath string
 
@@ -188,39 +254,42 @@ func main() {
 		outputDir = "."
 	}
 
+	// An FTP glob pattern or directory stands for several files
+	if url := options.URLs[0]; downloadutils.IsFTP(url) && options.OutputFile == "" && (strings.ContainsAny(filepath.Base(url), "*?[") || strings.HasSuffix(url, "/")) {
+		results := downloadutils.NewConcurrentDownloader(1, outputDir, options).DownloadURLs(ctx, []string{url})
+		exitIfInterrupted(ctx, "run again with -c to resume")
+		var errs []error
+		for _, result := range results {
+			errs = append(errs, result.Error)
+		}
+		os.Exit(downloadutils.ExitStatus(errs...))
+	}
+
 	// Get filename from -O flag or URL
 	var filename string
 	if options.OutputFile != "" {
 		filename = filepath.Base(options.OutputFile) // Only use the base name, not the full path
 	} else {
-		// Parse URL to get filename
-		parsedURL, err := url.Parse(options.URLs[0])
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: Invalid URL: %v\n", err)
-			os.Exit(1)
-		}
-
 		// Get filename from URL path
-		filename = filepath.Base(parsedURL.Path)
-		if filename == "" || filename == "." || filename == "/" {
-			filename = "index.html"
+		filename, err = downloadutils.FilenameFromURL(options.URLs[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(downloadutils.ExitCode(err))
 		}
-
-		// Clean filename (replace invalid characters)
-		filename = strings.Map(func(r rune) rune {
-			if strings.ContainsRune(`<>:"/\|?*`, r) {
-				return '_'
-			}
-			return r
-		}, filename)
 	}
 
 	// Combine directory and filename
 	outputPath = filepath.Clean(filepath.Join(outputDir, filename))
 
 	// Download the file
-	if err := downloadutils.DownloadFile(options.URLs[0], outputPath, options.RateLimit); err != nil {
+	if err := downloadutils.DownloadFile(ctx, options.URLs[0], outputPath, options); err != nil {
+		exitIfInterrupted(ctx, "%s", partialFileNote(outputPath))
+		var limitErr *downloadutils.LimitError
+		if errors.As(err, &limitErr) {
+			// Already reported as skipped, the limits did their job
+			return
+		}
 		fmt.Fprintf(os.Stderr, "Error downloading file: %v\n", err)
-		os.Exit(1)
+		os.Exit(downloadutils.ExitCode(err))
 	}
-}
\ No newline at end of file
+}
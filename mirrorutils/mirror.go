@@ -2,15 +2,21 @@ package mirrorutils
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"wget/downloadutils"
+	"wget/models"
 
 	"golang.org/x/net/html"
 )
@@ -23,10 +29,13 @@ type MirrorOptions struct {
 	UseDynamic   bool
 	RejectTypes  []string
 	ExcludePaths []string
+	Options      *models.Options // Download options shared with downloadutils (no-clobber, backups, ...)
+	session      *downloadutils.Session
 	visited      map[string]bool
 	currentDepth int
 	maxDepth     int
-	baseHost     string // Store the base host for domain matching
+	baseHost     string  // Store the base host for domain matching
+	errs         []error // Failures of the URLs found while crawling
 }
 
 // NewMirrorOptions creates a new MirrorOptions instance
@@ -50,25 +59,128 @@ func NewMirrorOptions(urlStr, outputDir string, convertLinks bool, rejectTypes [
 	}
 }
 
-// Mirror starts the website mirroring process
-func (m *MirrorOptions) Mirror() error {
+// Mirror starts the website mirroring process. Cancelling ctx stops it after the
+// current file, keeping what was already saved.
+func (m *MirrorOptions) Mirror(ctx context.Context) error {
 	// Create output directory
 	if err := os.MkdirAll(m.OutputDir, 0755); err != nil {
-		return fmt.Errorf("failed to create output directory: %v", err)
+		return &downloadutils.IOError{Err: fmt.Errorf("failed to create output directory: %v", err)}
 	}
 
 	fmt.Printf("Starting mirror of %s\n", m.URL)
 	fmt.Printf("Output directory: %s\n", m.OutputDir)
 
-	return m.ProcessUrl(m.URL)
+	m.errs = nil
+	var err error
+	if downloadutils.IsFTP(m.URL) {
+		err = m.mirrorFTP(ctx)
+	} else {
+		err = m.ProcessUrl(ctx, m.URL)
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		// Interrupted mid-crawl: the pages done so far succeeding doesn't make the mirror complete
+		err = ctxErr
+	} else if err == nil && len(m.errs) > 0 {
+		// Exit with the status of the failures, like wget does
+		err = downloadutils.JoinErrors(fmt.Sprintf("%d URL(s) failed to download", len(m.errs)), m.errs)
+	}
+
+	// Save cookies picked up while crawling
+	if m.session != nil {
+		m.session.ReportSkipped(os.Stdout)
+		if closeErr := m.session.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		m.session = nil
+	}
+	return err
+}
+
+// mirrorFTP downloads every file below an ftp:// directory, keeping the directory layout
+func (m *MirrorOptions) mirrorFTP(ctx context.Context) error {
+	// The listing and the files share the session of the mirror, and so its rate limits
+	session, err := m.httpSession()
+	if err != nil {
+		return err
+	}
+	files, err := downloadutils.ListFTP(ctx, session, m.URL, true)
+	if err != nil {
+		return err
+	}
+
+	client, err := downloadutils.NewClient(downloadutils.WithOptions(m.options()), downloadutils.WithSession(session))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, file := range files {
+		u, err := url.Parse(file)
+		if err != nil || m.skipFTPFile(u) {
+			continue
+		}
+
+		fmt.Printf("Downloading: %s\n", file)
+		outputPath := filepath.Join(m.OutputDir, u.Host, filepath.FromSlash(strings.TrimPrefix(u.Path, "/")))
+		if _, err := client.Do(ctx, &downloadutils.Request{URL: file, OutputPath: outputPath}); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			var limitErr *downloadutils.LimitError
+			if errors.As(err, &limitErr) {
+				fmt.Printf("Skipping %s: %s\n", file, limitErr.Reason)
+				continue
+			}
+			fmt.Printf("Error downloading %s: %v\n", file, err)
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return downloadutils.JoinErrors(fmt.Sprintf("%d of %d files failed to download", len(errs), len(files)), errs)
+	}
+	return nil
+}
+
+// skipFTPFile applies the --exclude and --reject lists to a file found while mirroring FTP
+func (m *MirrorOptions) skipFTPFile(u *url.URL) bool {
+	normalizedPath := strings.Trim(u.Path, "/")
+	for _, excludePath := range m.ExcludePaths {
+		if strings.HasPrefix(normalizedPath, strings.Trim(excludePath, "/")) {
+			fmt.Printf("Skipping excluded path: %s\n", u)
+			return true
+		}
+	}
+
+	filename := path.Base(u.Path)
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(u.Path)), ".")
+	for _, rejectedType := range m.RejectTypes {
+		if strings.EqualFold(filename, rejectedType) || (ext != "" && strings.EqualFold(ext, rejectedType)) {
+			fmt.Printf("Skipping rejected file: %s\n", u)
+			return true
+		}
+	}
+	return false
+}
+
+// fail reports a URL found while crawling that couldn't be processed, and keeps its error
+// for the outcome of the mirror
+func (m *MirrorOptions) fail(urlStr string, err error) {
+	fmt.Printf("Warning: Failed to process URL %s: %v\n", urlStr, err)
+	m.errs = append(m.errs, err)
 }
 
 // ProcessUrl downloads and processes a single URL
-func (m *MirrorOptions) ProcessUrl(urlStr string) error {
+func (m *MirrorOptions) ProcessUrl(ctx context.Context, urlStr string) error {
+	// Stop crawling once interrupted
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// Clean the URL by removing fragments and normalizing query parameters
 	parsedURL, err := url.Parse(urlStr)
 	if err != nil {
-		return fmt.Errorf("failed to parse URL %s: %v", urlStr, err)
+		return &downloadutils.ParseError{Err: fmt.Errorf("failed to parse URL %s: %v", urlStr, err)}
 	}
 
 	// Remove fragments and query parameters for visited check
@@ -147,33 +259,6 @@ func (m *MirrorOptions) ProcessUrl(urlStr string) error {
 
 	fmt.Printf("Downloading: %s\n", urlStr)
 
-	// Download the URL
-	req, err := http.NewRequest("GET", urlStr, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
-	}
-
-	// Add headers to make the request more browser-like
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,*/*;q=0.8")
-	req.Header.Set("Accept-Language", "en-US,en;q=0.5")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to download %s: %v", urlStr, err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download %s: status code %d", urlStr, resp.StatusCode)
-	}
-
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read response body: %v", err)
-	}
-
 	// Prepare output path for all cases
 	outputPath := filepath.Join(m.OutputDir, m.convertToLocalPath(parsedURL))
 
@@ -187,25 +272,68 @@ func (m *MirrorOptions) ProcessUrl(urlStr string) error {
 		outputPath = filepath.Join(outputPath, "index.html")
 	}
 
+	var body []byte
+	var contentType string
+	var header http.Header
+	if m.options().NoClobber && shouldSaveFile && fileExists(outputPath) {
+		// Keep the copy we already have, but still follow its links
+		fmt.Printf("File '%s' already there; not retrieving.\n", outputPath)
+		if body, contentType, err = readLocal(outputPath); err != nil {
+			return err
+		}
+		shouldSaveFile = false
+	} else {
+		body, contentType, header, err = m.fetch(ctx, urlStr, outputPath)
+		var limitErr *downloadutils.LimitError
+		if errors.As(err, &limitErr) {
+			// Left out of the mirror, the report at the end lists it
+			fmt.Printf("Skipping %s: %s\n", urlStr, limitErr.Reason)
+			return nil
+		}
+		if errors.Is(err, downloadutils.ErrNotModified) {
+			// Re-mirroring: the local copy is current, but its links may lead to changed files
+			fmt.Printf("Server file no newer than local file '%s' -- not retrieving.\n", outputPath)
+			if body, contentType, err = readLocal(outputPath); err != nil {
+				return err
+			}
+			shouldSaveFile = false
+		} else if err != nil {
+			return err
+		}
+	}
+
+	// Once the file is written (including converted links), record the server's timestamp
+	if shouldSaveFile && m.options().Timestamping {
+		defer func() {
+			if err := downloadutils.ApplyTimestamps(outputPath, header); err != nil {
+				fmt.Printf("Warning: %v\n", err)
+			}
+		}()
+	}
+
 	// Save file if not rejected
 	if shouldSaveFile {
 		// Create directory if it doesn't exist
 		dir := filepath.Dir(outputPath)
 		if err := os.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("failed to create directory %s: %v", dir, err)
+			return &downloadutils.IOError{Err: fmt.Errorf("failed to create directory %s: %v", dir, err)}
+		}
+
+		// Keep numbered backups of the copy we are about to replace
+		if err := downloadutils.RotateBackups(outputPath, m.options().Backups); err != nil {
+			return err
 		}
 
-		if err := os.WriteFile(outputPath, body, 0644); err != nil {
-			return fmt.Errorf("failed to write file: %v", err)
+		if err := downloadutils.WriteFileAtomic(outputPath, body, 0644); err != nil {
+			return &downloadutils.IOError{Err: fmt.Errorf("failed to write file: %v", err)}
 		}
 	}
 
 	// Process HTML content
-	contentType := resp.Header.Get("Content-Type")
 	if strings.Contains(contentType, "text/html") {
 		doc, err := html.Parse(bytes.NewReader(body))
 		if err != nil {
-			return fmt.Errorf("failed to parse HTML: %v", err)
+			return &downloadutils.ParseError{Err: fmt.Errorf("failed to parse HTML: %v", err)}
 		}
 
 		var processNode func(*html.Node)
@@ -230,7 +358,7 @@ func (m *MirrorOptions) ProcessUrl(urlStr string) error {
 						}
 
 						// Only process URLs from the same domain
-						if absURL.Host == m.baseHost {
+						if m.sameSite(absURL) {
 							// Update attribute to use local path or remote URL based on ConvertLinks
 							if m.ConvertLinks {
 								localPath := m.convertLinkPath(parsedURL, absURL)
@@ -249,8 +377,8 @@ func (m *MirrorOptions) ProcessUrl(urlStr string) error {
 
 							// Download linked resource
 							m.currentDepth++
-							if err := m.ProcessUrl(absURL.String()); err != nil {
-								fmt.Printf("Warning: Failed to process URL %s: %v\n", absURL.String(), err)
+							if err := m.ProcessUrl(ctx, absURL.String()); err != nil && ctx.Err() == nil {
+								m.fail(absURL.String(), err)
 							}
 							m.currentDepth--
 						}
@@ -264,7 +392,7 @@ func (m *MirrorOptions) ProcessUrl(urlStr string) error {
 								continue
 							}
 
-							if absURL.Host == m.baseHost {
+							if m.sameSite(absURL) {
 								localPath := m.convertLinkPath(parsedURL, absURL)
 								if m.ConvertLinks {
 									// Replace the URL in the style attribute with the local path
@@ -282,8 +410,8 @@ func (m *MirrorOptions) ProcessUrl(urlStr string) error {
 								}
 
 								m.currentDepth++
-								if err := m.ProcessUrl(absURL.String()); err != nil {
-									fmt.Printf("Warning: Failed to process URL %s: %v\n", absURL.String(), err)
+								if err := m.ProcessUrl(ctx, absURL.String()); err != nil && ctx.Err() == nil {
+									m.fail(absURL.String(), err)
 								}
 								m.currentDepth--
 							}
@@ -310,7 +438,7 @@ func (m *MirrorOptions) ProcessUrl(urlStr string) error {
 							continue
 						}
 
-						if absURL.Host == m.baseHost {
+						if m.sameSite(absURL) {
 							localPath := m.convertLinkPath(parsedURL, absURL)
 							if m.ConvertLinks {
 								// Replace the URL in the style tag with the local path
@@ -328,8 +456,8 @@ func (m *MirrorOptions) ProcessUrl(urlStr string) error {
 							}
 
 							m.currentDepth++
-							if err := m.ProcessUrl(absURL.String()); err != nil {
-								fmt.Printf("Warning: Failed to process URL %s: %v\n", absURL.String(), err)
+							if err := m.ProcessUrl(ctx, absURL.String()); err != nil && ctx.Err() == nil {
+								m.fail(absURL.String(), err)
 							}
 							m.currentDepth--
 						}
@@ -348,12 +476,12 @@ func (m *MirrorOptions) ProcessUrl(urlStr string) error {
 		if shouldSaveFile {
 			var buf bytes.Buffer
 			if err := html.Render(&buf, doc); err != nil {
-				return fmt.Errorf("failed to render HTML: %v", err)
+				return &downloadutils.IOError{Err: fmt.Errorf("failed to render HTML: %v", err)}
 			}
 
 			// Write the updated HTML back to the file
-			if err := os.WriteFile(outputPath, buf.Bytes(), 0644); err != nil {
-				return fmt.Errorf("failed to write updated HTML: %v", err)
+			if err := downloadutils.WriteFileAtomic(outputPath, buf.Bytes(), 0644); err != nil {
+				return &downloadutils.IOError{Err: fmt.Errorf("failed to write updated HTML: %v", err)}
 			}
 		}
 	} else if strings.Contains(contentType, "text/css") {
@@ -367,7 +495,7 @@ func (m *MirrorOptions) ProcessUrl(urlStr string) error {
 				continue
 			}
 
-			if absURL.Host == m.baseHost {
+			if m.sameSite(absURL) {
 				localPath := m.convertLinkPath(parsedURL, absURL)
 				if m.ConvertLinks {
 					// Replace the URL in the CSS file with the local path
@@ -384,8 +512,8 @@ func (m *MirrorOptions) ProcessUrl(urlStr string) error {
 				}
 
 				m.currentDepth++
-				if err := m.ProcessUrl(absURL.String()); err != nil {
-					fmt.Printf("Warning: Failed to process URL %s: %v\n", absURL.String(), err)
+				if err := m.ProcessUrl(ctx, absURL.String()); err != nil && ctx.Err() == nil {
+					m.fail(absURL.String(), err)
 				}
 				m.currentDepth--
 			}
@@ -393,8 +521,8 @@ func (m *MirrorOptions) ProcessUrl(urlStr string) error {
 
 		// Write the updated CSS back to the file if not rejected
 		if shouldSaveFile {
-			if err := os.WriteFile(outputPath, []byte(cssContent), 0644); err != nil {
-				return fmt.Errorf("failed to write updated CSS: %v", err)
+			if err := downloadutils.WriteFileAtomic(outputPath, []byte(cssContent), 0644); err != nil {
+				return &downloadutils.IOError{Err: fmt.Errorf("failed to write updated CSS: %v", err)}
 			}
 		}
 	}
@@ -402,6 +530,118 @@ func (m *MirrorOptions) ProcessUrl(urlStr string) error {
 	return nil
 }
 
+// options returns the download options, falling back to the defaults
+func (m *MirrorOptions) options() *models.Options {
+	if m.Options == nil {
+		return models.NewOptions()
+	}
+	return m.Options
+}
+
+// httpSession returns the session shared by every request of the mirror, creating it on first use
+func (m *MirrorOptions) httpSession() (*downloadutils.Session, error) {
+	if m.session == nil {
+		session, err := downloadutils.NewSession(m.options())
+		if err != nil {
+			return nil, err
+		}
+		// Credentials only go to the site being mirrored
+		session.AuthorizeHost(m.URL)
+		m.session = session
+	}
+	return m.session, nil
+}
+
+// browserUserAgent is sent while mirroring unless --user-agent is given, since some sites block non-browsers
+const browserUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36"
+
+// fetch downloads a URL and returns its body, content type and headers.
+// With timestamping it asks the server whether the copy at outputPath changed,
+// returning downloadutils.ErrNotModified if it didn't.
+func (m *MirrorOptions) fetch(ctx context.Context, urlStr, outputPath string) ([]byte, string, http.Header, error) {
+	session, err := m.httpSession()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	// Don't even ask the server once the quota or the number of files is used up
+	if err := session.CheckLimits(urlStr); err != nil {
+		return nil, "", nil, err
+	}
+
+	// file: and other schemes go through the download fetchers, without HTTP's extras
+	if u, err := url.Parse(urlStr); err == nil && u.Scheme != "http" && u.Scheme != "https" {
+		body, contentType, err := session.Fetch(ctx, urlStr)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("failed to download %s: %w", urlStr, err)
+		}
+		return body, contentType, nil, nil
+	}
+
+	req, err := downloadutils.NewRequest("GET", urlStr, nil, m.options())
+	if err != nil {
+		return nil, "", nil, err
+	}
+	req = req.WithContext(ctx)
+
+	// Add headers to make the request more browser-like, unless the user set their own
+	if m.options().UserAgent == "" {
+		req.Header.Set("User-Agent", browserUserAgent)
+	}
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,*/*;q=0.8")
+	}
+	if req.Header.Get("Accept-Language") == "" {
+		req.Header.Set("Accept-Language", "en-US,en;q=0.5")
+	}
+	if m.options().Timestamping {
+		downloadutils.AddConditionalHeaders(req, outputPath)
+	}
+
+	resp, err := session.Do(req)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to download %s: %w", urlStr, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, "", nil, downloadutils.ErrNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", nil, fmt.Errorf("failed to download %s: status code %d: %w", urlStr, resp.StatusCode, &downloadutils.HTTPError{Status: resp.Status, StatusCode: resp.StatusCode})
+	}
+
+	// Read response body, unless the download limits skip it
+	admitted, err := session.Admit(urlStr, resp.ContentLength, resp.Body)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	body, err := io.ReadAll(session.LimitReader(ctx, urlStr, admitted))
+	var limitErr *downloadutils.LimitError
+	if errors.As(err, &limitErr) {
+		return nil, "", nil, err
+	}
+	if err != nil {
+		return nil, "", nil, &downloadutils.NetworkError{Err: fmt.Errorf("failed to read response body: %v", err)}
+	}
+
+	return body, resp.Header.Get("Content-Type"), resp.Header, nil
+}
+
+// readLocal reads a previously mirrored file, guessing its content type from the extension
+func readLocal(path string) ([]byte, string, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", &downloadutils.IOError{Err: fmt.Errorf("failed to read existing file: %v", err)}
+	}
+	return body, mime.TypeByExtension(filepath.Ext(path)), nil
+}
+
+// fileExists reports whether a regular file exists at path
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
 // resolveURL converts a relative URL to an absolute URL
 func (m *MirrorOptions) resolveURL(base *url.URL, ref string) (*url.URL, error) {
 	refURL, err := url.Parse(ref)
@@ -411,6 +651,19 @@ func (m *MirrorOptions) resolveURL(base *url.URL, ref string) (*url.URL, error)
 	return base.ResolveReference(refURL), nil
 }
 
+// sameSite reports whether a link points into the site being mirrored. data: URLs are
+// inline content and never followed, file: URLs are only followed when mirroring local files.
+func (m *MirrorOptions) sameSite(u *url.URL) bool {
+	if strings.EqualFold(u.Scheme, "data") {
+		return false
+	}
+	isFile := strings.EqualFold(u.Scheme, "file")
+	if start, err := url.Parse(m.URL); err == nil && isFile != strings.EqualFold(start.Scheme, "file") {
+		return false
+	}
+	return u.Host == m.baseHost
+}
+
 // convertToLocalPath converts a URL to a local file path
 func (m *MirrorOptions) convertToLocalPath(u *url.URL) string {
 	// Get the path without query parameters and fragments
@@ -542,7 +795,7 @@ const hardcodedURL = "https://trypap.com/"
 // Start the mirroring process
 func StartMirroring() {
 	options := NewMirrorOptions(hardcodedURL, "output_directory", true, nil, nil)
-	if err := options.Mirror(); err != nil {
+	if err := options.Mirror(context.Background()); err != nil {
 		fmt.Printf("Error during mirroring: %v\n", err)
 	}
 }
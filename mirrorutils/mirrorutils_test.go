@@ -2,12 +2,21 @@ package mirrorutils
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"wget/downloadutils"
+	"wget/models"
 )
 
 // Mock ProcessUrl method for testing
@@ -55,7 +64,7 @@ func TestMirror(t *testing.T) {
 			os.Stdout = w
 
 			// Call the Mirror function
-			err := m.Mirror()
+			err := m.Mirror(context.Background())
 
 			// Restore stdout
 			w.Close()
@@ -94,7 +103,7 @@ func TestProcessUrl(t *testing.T) {
 	os.Stdout = w
 
 	// Call the ProcessUrl function
-	err := m.ProcessUrl("http://example.com")
+	err := m.ProcessUrl(context.Background(), "http://example.com")
 
 	// Restore stdout
 	w.Close()
@@ -235,3 +244,269 @@ func TestExtractURLsFromCSS(t *testing.T) {
 		})
 	}
 }
+
+func TestMirrorCollisionPolicies(t *testing.T) {
+	page := "<html><body>first</body></html>"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, page)
+	}))
+	defer server.Close()
+
+	outputDir := t.TempDir()
+	mirror := func(opts *models.Options) string {
+		m := NewMirrorOptions(server.URL+"/", outputDir, false, nil, nil)
+		m.Options = opts
+		if err := m.Mirror(context.Background()); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		parsedURL, _ := url.Parse(server.URL + "/")
+		return filepath.Join(outputDir, m.convertToLocalPath(parsedURL))
+	}
+
+	// First run, then a second one keeping a backup of the first copy
+	indexPath := mirror(&models.Options{Backups: 1})
+	page = "<html><body>second</body></html>"
+	mirror(&models.Options{Backups: 1})
+
+	if backup, err := os.ReadFile(indexPath + ".1"); err != nil || !strings.Contains(string(backup), "first") {
+		t.Errorf("expected backup of the first copy, got %q (%v)", backup, err)
+	}
+
+	// With no-clobber the existing copy is kept
+	page = "<html><body>third</body></html>"
+	mirror(&models.Options{NoClobber: true})
+
+	if current, _ := os.ReadFile(indexPath); !strings.Contains(string(current), "second") {
+		t.Errorf("expected no-clobber to keep the second copy, got %q", current)
+	}
+}
+
+func TestMirrorTimestamping(t *testing.T) {
+	fullResponses := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("ETag", `"page"`)
+		if r.Header.Get("If-None-Match") == `"page"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fullResponses++
+		fmt.Fprint(w, "<html><body>page</body></html>")
+	}))
+	defer server.Close()
+
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	outputDir := t.TempDir()
+	for run := 0; run < 2; run++ {
+		m := NewMirrorOptions(server.URL+"/", outputDir, false, nil, nil)
+		m.Options = &models.Options{Timestamping: true}
+		if err := m.Mirror(context.Background()); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+
+	if fullResponses != 1 {
+		t.Errorf("expected the page to be transferred once, got %d", fullResponses)
+	}
+	host := strings.TrimPrefix(server.URL, "http://")
+	if entries, _ := os.ReadDir(filepath.Join(outputDir, host)); len(entries) != 1 {
+		t.Errorf("expected only the page in the mirror, got %v", entries)
+	}
+}
+
+func TestMirrorCustomHeaders(t *testing.T) {
+	var gotAgent, gotToken string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAgent = r.UserAgent()
+		gotToken = r.Header.Get("X-Token")
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html></html>")
+	}))
+	defer server.Close()
+
+	m := NewMirrorOptions(server.URL+"/", t.TempDir(), false, nil, nil)
+	m.Options = &models.Options{UserAgent: "mirror-bot", Headers: []string{"X-Token: secret"}}
+	if err := m.Mirror(context.Background()); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if gotAgent != "mirror-bot" || gotToken != "secret" {
+		t.Errorf("expected custom User-Agent and header, got %q and %q", gotAgent, gotToken)
+	}
+}
+
+func TestMirrorSharesCookies(t *testing.T) {
+	var pageCookie string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "login", Value: "yes", Path: "/"})
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body><a href="/private/page.html">private</a></body></html>`)
+	})
+	mux.HandleFunc("/private/page.html", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("login"); err == nil {
+			pageCookie = c.Value
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html></html>")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	m := NewMirrorOptions(server.URL+"/", t.TempDir(), false, nil, nil)
+	if err := m.Mirror(context.Background()); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if pageCookie != "yes" {
+		t.Errorf("expected cookie from the first page to be sent to the second, got %q", pageCookie)
+	}
+}
+
+func TestMirrorAuthentication(t *testing.T) {
+	var pages []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "alice" || password != "s3cret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="private"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		pages = append(pages, r.URL.Path)
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body><a href="/page.html">page</a></body></html>`)
+	}))
+	defer server.Close()
+
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "missing"))
+	m := NewMirrorOptions(server.URL+"/", t.TempDir(), false, nil, nil)
+	m.Options = &models.Options{User: "alice", Password: "s3cret"}
+	if err := m.Mirror(context.Background()); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if len(pages) != 2 {
+		t.Errorf("expected both pages to be fetched with credentials, got %v", pages)
+	}
+}
+
+func TestMirrorLocalFiles(t *testing.T) {
+	site := t.TempDir()
+	index := `<html><body><a href="page.html">page</a><img src="data:image/png;base64,iVBORw0KGgo="></body></html>`
+	os.WriteFile(filepath.Join(site, "index.html"), []byte(index), 0o644)
+	os.WriteFile(filepath.Join(site, "page.html"), []byte("<html><body>page</body></html>"), 0o644)
+
+	outputDir := t.TempDir()
+	m := NewMirrorOptions("file://"+filepath.ToSlash(filepath.Join(site, "index.html")), outputDir, false, nil, nil)
+	if err := m.Mirror(context.Background()); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	mirrored, err := os.ReadFile(filepath.Join(outputDir, filepath.FromSlash(filepath.ToSlash(site)), "index.html"))
+	if err != nil {
+		t.Fatalf("expected index.html to be mirrored: %v", err)
+	}
+	if !strings.Contains(string(mirrored), "data:image/png;base64,iVBORw0KGgo=") {
+		t.Errorf("expected data: link to be kept inline, got %s", mirrored)
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, site, "page.html")); err != nil {
+		t.Errorf("expected linked page to be mirrored: %v", err)
+	}
+}
+
+func TestMirrorCancelled(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><body><a href="/page.html">page</a></body></html>`))
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	m := NewMirrorOptions(server.URL+"/", t.TempDir(), false, nil, nil)
+	if err := m.Mirror(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if requests != 0 {
+		t.Errorf("expected no requests after cancellation, got %d", requests)
+	}
+}
+
+func TestMirrorCancelledMidCrawl(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/page.html" {
+			// Interrupted while the linked page is being fetched
+			cancel()
+		}
+		fmt.Fprint(w, `<html><body><a href="/page.html">page</a></body></html>`)
+	}))
+	defer server.Close()
+
+	m := NewMirrorOptions(server.URL+"/", t.TempDir(), false, nil, nil)
+	if err := m.Mirror(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestMirrorLimits(t *testing.T) {
+	var pages []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pages = append(pages, r.URL.Path)
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/big.html" {
+			fmt.Fprint(w, strings.Repeat("x", 4096))
+			return
+		}
+		fmt.Fprint(w, `<html><body><a href="/big.html">big</a><a href="/a.html">a</a><a href="/b.html">b</a></body></html>`)
+	}))
+	defer server.Close()
+
+	outputDir := t.TempDir()
+	m := NewMirrorOptions(server.URL+"/", outputDir, false, nil, nil)
+	m.Options = &models.Options{MaxFileSize: "1k", MaxFiles: 2}
+	if err := m.Mirror(context.Background()); err != nil {
+		t.Fatalf("expected the limits to skip files without failing, got: %v", err)
+	}
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	if _, err := os.Stat(filepath.Join(outputDir, host, "big.html")); err == nil {
+		t.Errorf("expected big.html to be skipped for its size")
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, host, "a.html")); err != nil {
+		t.Errorf("expected a.html to be mirrored as the second file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, host, "b.html")); err == nil {
+		t.Errorf("expected b.html to be skipped once 2 files were downloaded")
+	}
+	if slices.Contains(pages, "/b.html") {
+		t.Errorf("expected no request once the file limit was reached, got %v", pages)
+	}
+}
+
+func TestMirrorFailedLinks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body><a href="/missing.html">missing</a><img src="/gone.png"></body></html>`)
+	}))
+	defer server.Close()
+
+	m := NewMirrorOptions(server.URL+"/", t.TempDir(), false, nil, nil)
+	err := m.Mirror(context.Background())
+	var httpErr *downloadutils.HTTPError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("expected the broken links to fail the mirror, got: %v", err)
+	}
+	if code := downloadutils.ExitCode(err); code != downloadutils.ExitServer {
+		t.Errorf("expected exit code %d, got %d", downloadutils.ExitServer, code)
+	}
+}
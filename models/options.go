@@ -1,38 +1,135 @@
 package models
 
+import "time"
+
 // Options holds the command line options
 type Options struct {
 	// URLs to download (non-flag arguments)
-	URLs          []string
+	URLs []string
 	// Background download flag
-	Background    bool
+	Background bool
 	// Custom output filename
-	OutputFile    string
+	OutputFile string
 	// Custom output directory
-	OutputPath    string
-	// Download speed limit (e.g., "200k", "2M")
-	RateLimit     string
+	OutputPath string
+	// Download speed limit (e.g., "200k", "2M"), shared by all downloads of a run
+	RateLimit string
+	// Speed limits by time of day (e.g., "08:00-18:00=500k,18:00-08:00=0"), --rate-limit applying outside them
+	RateSchedule string
+	// Speed limits for single hosts ("HOST=RATE", e.g., "example.com=100k")
+	HostRateLimits []string
+	// Stop starting new downloads once this many bytes were downloaded (e.g., "100M")
+	Quota string
+	// Skip files larger than this (e.g., "10M")
+	MaxFileSize string
+	// Download at most this many files
+	MaxFiles int
 	// Input file containing URLs
-	InputFile     string
+	InputFile string
 	// Track if we're writing to a log file
-	IsLogging     bool
+	IsLogging bool
 	// Mirror website
-	Mirror        bool
+	Mirror bool
 	// List of file extensions to reject
-	RejectTypes   []string // List of file extensions to reject
+	RejectTypes []string // List of file extensions to reject
 	// List of paths to exclude
-	ExcludePaths  []string // List of paths to exclude
+	ExcludePaths []string // List of paths to exclude
 	// Convert links for offline viewing
-	ConvertLinks  bool     // Convert links for offline viewing
+	ConvertLinks bool // Convert links for offline viewing
 	// Enable JavaScript rendering
-	UseDynamic    bool     // Enable JavaScript rendering
+	UseDynamic bool // Enable JavaScript rendering
+	// Resume a partially downloaded file
+	Continue bool
+	// Number of attempts per download (1 means no retries)
+	Tries int
+	// Maximum wait between retries
+	WaitRetry time.Duration
+	// Extra HTTP status codes that should be retried
+	RetryOnHTTPError []int
+	// Number of parallel byte-range requests per file
+	Segments int
+	// Expected checksum of a single download (e.g., "sha256:<hex>")
+	Checksum string
+	// Checksum manifest to verify (or write) after downloading an input file
+	ChecksumManifest string
+	// Name files after the Content-Disposition header
+	ContentDisposition bool
+	// Name files after the final URL of a redirect
+	TrustServerNames bool
+	// Keep existing files instead of downloading them again
+	NoClobber bool
+	// Number of backups to keep when replacing a file
+	Backups int
+	// Only download files newer than the local copy
+	Timestamping bool
+	// Extra request headers ("Name: value")
+	Headers []string
+	// User-Agent to send instead of the default
+	UserAgent string
+	// HTTP method for downloads (defaults to GET, or POST with a body)
+	Method string
+	// Request body sent with downloads
+	PostData string
+	// File whose contents are sent as the request body
+	BodyFile string
+	// Netscape cookies.txt file to load cookies from
+	LoadCookies string
+	// Netscape cookies.txt file to save cookies to
+	SaveCookies string
+	// Also save cookies that expire with the session
+	KeepSessionCookies bool
+	// User name for HTTP authentication
+	User string
+	// Password for HTTP authentication
+	Password string
+	// Prompt for the password instead of taking it from the command line
+	AskPassword bool
+	// Bearer token sent as "Authorization: Bearer <token>"
+	BearerToken string
+	// Don't look up credentials in ~/.netrc
+	NoNetrc bool
+	// Proxy to use instead of the http_proxy/https_proxy environment variables
+	Proxy string
+	// Don't use any proxy
+	NoProxy bool
+	// User name for proxy authentication
+	ProxyUser string
+	// Password for proxy authentication
+	ProxyPassword string
+	// PEM file with extra certificate authorities to trust
+	CACertificate string
+	// Directory of PEM files with extra certificate authorities to trust
+	CADirectory string
+	// Client certificate (PEM) for mutual TLS
+	Certificate string
+	// Private key (PEM) of the client certificate, if not in the certificate file
+	PrivateKey string
+	// Don't verify server certificates
+	NoCheckCertificate bool
+	// Oldest TLS version to accept ("1.0" to "1.3")
+	MinTLSVersion string
+	// Public key the server must present ("sha256//<base64>" hashes or a key file)
+	PinnedPubKey string
+	// Default for the DNS, connect and read timeouts
+	Timeout time.Duration
+	// Give up resolving a host name after this long
+	DNSTimeout time.Duration
+	// Give up connecting after this long
+	ConnectTimeout time.Duration
+	// Give up when a read gets no data for this long
+	ReadTimeout time.Duration
+	// Abort (and retry) a download that receives no data for this long
+	StallTimeout time.Duration
+	// Use active FTP (the server connects back to us) instead of passive
+	NoPassiveFTP bool
 }
 
 // NewOptions creates a new Options instance with default values
 func NewOptions() *Options {
 	return &Options{
 		Background: false,
+		Tries:      1,
 		OutputPath: ".",
-		URLs:      []string{},
+		URLs:       []string{},
 	}
 }